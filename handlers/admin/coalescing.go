@@ -0,0 +1,36 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/8legd/RRP/logging/elf"
+	"github.com/8legd/RRP/processors"
+)
+
+// coalescingStatus is the response of admin/coalescing
+type coalescingStatus struct {
+	Enabled bool `json:"enabled"`
+	processors.CoalesceStats
+}
+
+// Coalescing reports the metrics of the coalescing of identical requests sent concurrently by different batches
+// (see processors.Coalescer) e.g. `{"enabled": true, "eligible": 120, "sent": 45, "coalesced": 75, "inFlight": 2}`
+func Coalescing(w http.ResponseWriter, r *http.Request) {
+	started := time.Now()
+	requestID := "REQUEST_ID:" + r.Header.Get("x-request-id")
+	var status coalescingStatus
+	if processors.Coalescing != nil {
+		status = coalescingStatus{true, processors.Coalescing.Stats()}
+	}
+	out, err := json.Marshal(status)
+	if err != nil {
+		elf.Log("ERROR", "Error whilst processing admin/coalescing request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(out)
+}
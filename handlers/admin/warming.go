@@ -0,0 +1,36 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/8legd/RRP/logging/elf"
+	"github.com/8legd/RRP/processors"
+)
+
+// warmingStatus is the response of admin/warming
+type warmingStatus struct {
+	Enabled bool                    `json:"enabled"`
+	Targets []processors.WarmStatus `json:"targets"`
+}
+
+// Warming reports the status of warming the responses to the configured requests in the cache (see processors.Warmer)
+// e.g. `{"enabled": true, "targets": [{"url": "https://api.example.com/reports/daily", "interval": "15m0s", "warmed": 4, ...}]}`
+func Warming(w http.ResponseWriter, r *http.Request) {
+	started := time.Now()
+	requestID := "REQUEST_ID:" + r.Header.Get("x-request-id")
+	status := warmingStatus{Targets: []processors.WarmStatus{}}
+	if processors.Warming != nil {
+		status = warmingStatus{true, processors.Warming.Status()}
+	}
+	out, err := json.Marshal(status)
+	if err != nil {
+		elf.Log("ERROR", "Error whilst processing admin/warming request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(out)
+}
@@ -0,0 +1,221 @@
+package batch
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/8legd/RRP/logging/elf"
+	"github.com/8legd/RRP/processors"
+)
+
+func handleError(w http.ResponseWriter, started time.Time, requestID string, statusCode int, errMsg string, cause error) {
+	elf.Log("ERROR", errMsg, elf.LogOptions{Tags: requestID, Cause: cause, Started: started})
+	http.Error(w, errMsg, statusCode)
+}
+
+// parseTimeout reads the optional `x-rrp-timeout` header (a positive number of seconds, see parseSeconds) of a batch
+// request falling back to the default timeout when it is not specified.
+// On error a 400 (Bad Request) is sent and ok is false.
+func parseTimeout(w http.ResponseWriter, r *http.Request, started time.Time, requestID string, handler string) (timeout time.Duration, ok bool) {
+	tm := r.Header.Get("x-rrp-timeout")
+	if tm == "" {
+		timeout = processors.DefaultTimeout // Default timeout
+		elf.Log("INFO", "Timeout used is default value of "+strconv.FormatFloat(timeout.Seconds(), 'f', 3, 64), elf.LogOptions{Tags: requestID, Started: started})
+		return timeout, true
+	}
+	timeout, err := parseSeconds(tm)
+	if err != nil {
+		elf.Log("ERROR", "Error parsing `x-rrp-timeout` header of "+handler+" request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
+		http.Error(w, "invalid value for x-rrp-timeout header, expected number of seconds", http.StatusBadRequest)
+		return 0, false
+	}
+	elf.Log("INFO", "Timeout as specified in request is "+strconv.FormatFloat(timeout.Seconds(), 'f', 3, 64), elf.LogOptions{Tags: requestID, Started: started})
+	return timeout, true
+}
+
+// parseDeadline reads the optional `x-rrp-deadline` header (number of seconds) of a batch request
+// which caps the total time taken to process the batch (measured from when the batch request was started).
+// On error a 400 (Bad Request) is sent and ok is false.
+func parseDeadline(w http.ResponseWriter, r *http.Request, started time.Time, requestID string, handler string) (deadline time.Time, ok bool) {
+	dl := r.Header.Get("x-rrp-deadline")
+	if dl == "" {
+		return time.Time{}, true
+	}
+	d, err := parseSeconds(dl)
+	if err != nil {
+		elf.Log("ERROR", "Error parsing `x-rrp-deadline` header of "+handler+" request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
+		http.Error(w, "invalid value for x-rrp-deadline header, expected number of seconds", http.StatusBadRequest)
+		return time.Time{}, false
+	}
+	elf.Log("INFO", "Deadline as specified in request is "+strconv.FormatFloat(d.Seconds(), 'f', 3, 64), elf.LogOptions{Tags: requestID, Started: started})
+	return started.Add(d), true
+}
+
+// partTimeout reads (and removes) the optional `x-rrp-timeout` header (number of seconds)
+// of an individual request in a batch, returning 0 if it is not specified
+func partTimeout(header http.Header) (time.Duration, error) {
+	tm := header.Get("x-rrp-timeout")
+	header.Del("x-rrp-timeout")
+	if tm == "" {
+		return 0, nil
+	}
+	timeout, err := parseSeconds(tm)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for x-rrp-timeout header, expected number of seconds: %s", err.Error())
+	}
+	return timeout, nil
+}
+
+// parseSeconds parses a positive number of seconds with up to millisecond precision e.g. `2.5`
+func parseSeconds(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(strings.TrimSpace(s) + "s")
+	if err != nil {
+		return 0, err
+	}
+	d = d.Round(time.Millisecond)
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid duration %s, expected a positive number of seconds", s)
+	}
+	return d, nil
+}
+
+// parseMode reads the optional `x-rrp-mode` header of a batch request which specifies how its requests are executed
+// (`parallel`, `sequential` or `sequential-stop-on-error`) falling back to parallel when it is not specified.
+// On error a 400 (Bad Request) is sent and ok is false.
+func parseMode(w http.ResponseWriter, r *http.Request, started time.Time, requestID string, handler string) (mode processors.Mode, ok bool) {
+	mode = processors.Mode(r.Header.Get("x-rrp-mode"))
+	switch mode {
+	case "":
+		return processors.ModeParallel, true
+	case processors.ModeParallel, processors.ModeSequential, processors.ModeSequentialStopOnError:
+		elf.Log("INFO", "Mode as specified in request is "+string(mode), elf.LogOptions{Tags: requestID, Started: started})
+		return mode, true
+	}
+	err := fmt.Errorf("unsupported mode %s", mode)
+	elf.Log("ERROR", "Error parsing `x-rrp-mode` header of "+handler+" request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
+	http.Error(w, "invalid value for x-rrp-mode header, expected parallel, sequential or sequential-stop-on-error", http.StatusBadRequest)
+	return "", false
+}
+
+// parseFlag reads an optional boolean header (e.g. `x-rrp-stream`) of a batch request, returning false if it is not specified.
+// On error a 400 (Bad Request) is sent and ok is false.
+func parseFlag(w http.ResponseWriter, r *http.Request, started time.Time, requestID string, handler string, name string) (flag bool, ok bool) {
+	value := r.Header.Get(name)
+	if value == "" {
+		return false, true
+	}
+	flag, err := strconv.ParseBool(value)
+	if err != nil {
+		elf.Log("ERROR", "Error parsing `"+name+"` header of "+handler+" request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
+		http.Error(w, "invalid value for "+name+" header, expected true or false", http.StatusBadRequest)
+		return false, false
+	}
+	return flag, true
+}
+
+// processBatch processes the requests of a batch using processors.StreamBatch.
+// The requests and responses are in the same sequence as the batch. Any requests which
+// already have a response (e.g. an error response because they were malformed) are
+// not sent and the remaining responses are filled in once processed.
+// If done is not nil it is called with the sequence of each response as soon as it is available.
+// The number of calls saved by identical requests in the batch only being sent once is logged.
+func processBatch(requests []*http.Request, responses []*processors.BatchedResponse, timeout time.Duration, options processors.BatchOptions, requestID string, done func(int)) error {
+	if options.Parts == nil {
+		options.Parts = make([]processors.PartOptions, len(requests))
+	}
+	for i := range responses {
+		if responses[i] != nil {
+			options.Parts[i].Response = responses[i]
+		}
+	}
+	received, deduplicated := 0, 0
+	for r := range processors.StreamBatch(requests, timeout, options) {
+		response := r
+		responses[response.Sequence] = &response
+		received++
+		if response.Deduplicated {
+			deduplicated++
+		}
+		if done != nil {
+			done(response.Sequence)
+		}
+	}
+	if deduplicated > 0 {
+		elf.Log("INFO", "Deduplicated identical requests in batch", elf.LogOptions{Tags: requestID, Payload: "saved=" + strconv.Itoa(deduplicated)})
+	}
+	if received != len(requests) {
+		return fmt.Errorf("expected %d responses for this batch but only recieved %d", len(requests), received)
+	}
+	return nil
+}
+
+// dependencies returns the sequences of the requests with the specified ids (as per a `x-rrp-depends-on` header or `dependsOn` field)
+// which the request with the specified sequence depends on. The ids are given in the same sequence as the requests of the batch
+// and only those of earlier requests are searched.
+func dependencies(sequence int, dependsOn []string, ids []string) ([]int, error) {
+	var sequences []int
+	for _, d := range dependsOn {
+		d = trimContentID(d)
+		if d == "" {
+			continue
+		}
+		found := false
+		for i, id := range ids[:sequence] {
+			if id == d {
+				sequences = append(sequences, i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("invalid dependency %s, expected the id of an earlier request in the batch", d)
+		}
+	}
+	return sequences, nil
+}
+
+// trimContentID returns a Content-ID without any surrounding angle brackets e.g. `<item1>` becomes `item1`
+// (this is the form used to reference the request in dependencies)
+func trimContentID(contentID string) string {
+	contentID = strings.TrimSpace(contentID)
+	if strings.HasPrefix(contentID, "<") && strings.HasSuffix(contentID, ">") {
+		return contentID[1 : len(contentID)-1]
+	}
+	return contentID
+}
+
+// responseContentID returns the Content-ID for a response part given the Content-ID of its request part.
+// As per Google's batch processing the id is prefixed with `response-` e.g. `<item1>` becomes `<response-item1>`
+func responseContentID(contentID string) string {
+	if strings.HasPrefix(contentID, "<") && strings.HasSuffix(contentID, ">") {
+		return "<response-" + contentID[1:len(contentID)-1] + ">"
+	}
+	return "response-" + contentID
+}
+
+// logResponse logs the response received for an individual request in a batch
+// (along with an error for a response which exceeded processors.MaxResponseSize)
+func logResponse(requestID string, url string, response *processors.BatchedResponse) {
+	started := time.Now().Add(response.ProcessingDuration * -1)
+	if response.Header != nil && response.Header.Get(processors.ErrorCodeHeader) == "response_too_large" {
+		err := fmt.Errorf("response from %s exceeds the maximum size of %d bytes", url, processors.MaxResponseSize)
+		elf.Log("ERROR", "Limit exceeded by response to batched request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
+	}
+	// the timings of each phase of sending the request are included as the payload (if it was sent)
+	payload := ""
+	if response.Deduplicated {
+		payload = "deduplicated=true"
+	} else if !response.Started.IsZero() {
+		payload = response.Timings.String(response.ProcessingDuration)
+	}
+	elf.Log("INFO", "Received "+response.Status+" from "+url, elf.LogOptions{Tags: requestID, Started: started, Payload: payload})
+}
+
+// serverTiming summarises the timings of the responses of a batch for the `Server-Timing` header of the batch response
+// i.e. the longest time taken for each phase by any of its requests along with the total time taken for the batch
+func serverTiming(started time.Time, responses []*processors.BatchedResponse) string {
+	return processors.SlowestTimings(responses).ServerTiming(time.Since(started))
+}
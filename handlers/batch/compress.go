@@ -0,0 +1,120 @@
+package batch
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressor is implemented by gzip.Writer and flate.Writer
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// newCompressor returns a compressor writing to w for the specified content coding (gzip or deflate)
+func newCompressor(w io.Writer, encoding string) compressor {
+	if encoding == "deflate" {
+		fw, _ := flate.NewWriter(w, flate.DefaultCompression) // (only errors for an invalid compression level)
+		return fw
+	}
+	return gzip.NewWriter(w)
+}
+
+// negotiateEncoding works out which content coding (gzip or deflate) to use for the response to a batch request
+// from its `Accept-Encoding` header e.g. `gzip;q=1.0, deflate;q=0.5`, returning an empty string if neither is acceptable.
+// Where both are equally acceptable gzip is used.
+func negotiateEncoding(acceptEncoding string) string {
+	qualities := map[string]float64{}
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		qualities[name] = q
+	}
+	encoding, best := "", 0.0
+	for _, name := range []string{"gzip", "deflate"} {
+		q, ok := qualities[name]
+		if !ok {
+			q = qualities["*"] // (zero if there is no wildcard)
+		}
+		if q > best {
+			encoding, best = name, q
+		}
+	}
+	return encoding
+}
+
+// compressWriter is an http.ResponseWriter which compresses the response to a batch request
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	compressor  compressor
+	wroteHeader bool
+}
+
+// compressResponse negotiates the content coding for the response to a batch request (see negotiateEncoding)
+// returning an http.ResponseWriter which compresses the response accordingly. The returned function must be
+// called once the response has been written to write any remaining compressed data.
+func compressResponse(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return w, func() {}
+	}
+	cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+	return cw, cw.close
+}
+
+func (cw *compressWriter) WriteHeader(statusCode int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.Header().Set("Content-Encoding", cw.encoding)
+	cw.Header().Del("Content-Length")
+	cw.compressor = newCompressor(cw.ResponseWriter, cw.encoding)
+	cw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	return cw.compressor.Write(b)
+}
+
+// Flush writes any data compressed so far to the client (as used when streaming responses)
+func (cw *compressWriter) Flush() {
+	if cw.compressor != nil {
+		cw.compressor.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying http.ResponseWriter (as used by http.ResponseController)
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *compressWriter) close() {
+	if cw.compressor != nil {
+		cw.compressor.Close()
+	}
+}
@@ -0,0 +1,115 @@
+package batch
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	t.Log("We should be able to negotiate the encoding of a batch response")
+	{
+		for acceptEncoding, expected := range map[string]string{
+			"":                         "",
+			"identity":                 "",
+			"gzip":                     "gzip",
+			"deflate":                  "deflate",
+			"deflate, gzip":            "gzip",
+			"gzip;q=0.5, deflate":      "deflate",
+			"gzip;q=0, deflate;q=0":    "",
+			"*":                        "gzip",
+			"*;q=0.1, deflate;q=0.5":   "deflate",
+			"br, GZIP;q=0.8, identity": "gzip",
+		} {
+			if encoding := negotiateEncoding(acceptEncoding); encoding == expected {
+				t.Logf("\t\tShould use %q for %q %v", expected, acceptEncoding, tick)
+			} else {
+				t.Errorf("\t\tShould use %q for %q, but used %q %v", expected, acceptEncoding, encoding, cross)
+			}
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("Hello Bob ", 100)))
+	}))
+	defer upstream.Close()
+	part := "GET " + upstream.URL + "/ HTTP/1.1\r\n\r\n"
+
+	t.Log("We should be able to receive a compressed batch/multipartmixed response")
+	{
+		for _, stream := range []string{"false", "true"} {
+			rec := postMultipartMixed(t, http.Header{"Accept-Encoding": {"gzip"}, "X-Rrp-Stream": {stream}}, part, part)
+			if rec.Header().Get("Content-Encoding") != "gzip" {
+				t.Errorf("\t\tShould receive a gzip response when streaming is %s, but received %q %v", stream, rec.Header().Get("Content-Encoding"), cross)
+				continue
+			}
+			zr, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatalf("\t\tShould receive a valid gzip response, but received %s %v", err, cross)
+			}
+			responses := readResponseParts(t, zr, rec.Header().Get("Content-Type"))
+			if len(responses) == 2 && responses[1].StatusCode == http.StatusOK {
+				t.Logf("\t\tShould receive a gzip response when streaming is %s %v", stream, tick)
+			} else {
+				t.Errorf("\t\tShould receive a gzip response when streaming is %s, but received %d responses %v", stream, len(responses), cross)
+			}
+		}
+	}
+
+	t.Log("We should be able to receive a compressed batch/json response")
+	{
+		req := httptest.NewRequest("POST", "/batch/json", strings.NewReader(`[{"url": "`+upstream.URL+`"}]`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept-Encoding", "deflate")
+		rec := httptest.NewRecorder()
+		JSON(rec, req)
+		var responses []jsonResponse
+		err := json.NewDecoder(flate.NewReader(rec.Body)).Decode(&responses)
+		if rec.Header().Get("Content-Encoding") == "deflate" && err == nil && len(responses) == 1 && responses[0].StatusCode == http.StatusOK {
+			t.Log("\t\tShould receive a deflate response", tick)
+		} else {
+			t.Errorf("\t\tShould receive a deflate response, but received %q %v %v", rec.Header().Get("Content-Encoding"), err, cross)
+		}
+	}
+
+	t.Log("We should be able to receive compressed response parts")
+	{
+		rec := postMultipartMixed(t, http.Header{"X-Rrp-Part-Encoding": {"gzip"}}, part, changeset(t, part))
+		_, params, _ := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+		mr := multipart.NewReader(rec.Body, params["boundary"])
+		p, err := mr.NextPart()
+		if err != nil || p.Header.Get("Content-Encoding") != "gzip" {
+			t.Fatalf("\t\tShould receive a part with a Content-Encoding of gzip %v", cross)
+		}
+		zr, err := gzip.NewReader(p)
+		if err != nil {
+			t.Fatalf("\t\tShould receive a valid gzip part, but received %s %v", err, cross)
+		}
+		pb, _ := ioutil.ReadAll(zr)
+		if bytes.HasPrefix(pb, []byte("HTTP/1.1 200 OK")) {
+			t.Log("\t\tShould compress the content of the part", tick)
+		} else {
+			t.Errorf("\t\tShould compress the content of the part, but received %q %v", pb, cross)
+		}
+	}
+
+	t.Log("We should not be able to specify an unsupported part encoding")
+	{
+		rec := postMultipartMixed(t, http.Header{"X-Rrp-Part-Encoding": {"br"}}, part)
+		if rec.Code == http.StatusBadRequest {
+			t.Log("\t\tShould receive a 400 (Bad Request)", tick)
+		} else {
+			t.Errorf("\t\tShould receive a 400 (Bad Request), but received %d %v", rec.Code, cross)
+		}
+	}
+}
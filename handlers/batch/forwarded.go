@@ -0,0 +1,158 @@
+package batch
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// forwardedElement is an individual element of a Forwarded header as per RFC 7239 (https://tools.ietf.org/html/rfc7239)
+// e.g. `for=192.0.2.60;proto=http;by=203.0.113.43`
+type forwardedElement struct {
+	By    string
+	For   string
+	Host  string
+	Proto string
+}
+
+// parseForwarded parses the values of the Forwarded header(s) of a request into their elements.
+// Parameter names are case-insensitive and values can be tokens or quoted strings e.g. `for="[2001:db8:cafe::17]:4711"`
+func parseForwarded(values []string) ([]forwardedElement, error) {
+	var elements []forwardedElement
+	for _, value := range values {
+		element := forwardedElement{}
+		empty := true
+		i := 0
+		for i <= len(value) {
+			// skip whitespace around pairs
+			for i < len(value) && (value[i] == ' ' || value[i] == '\t') {
+				i++
+			}
+			if i == len(value) || value[i] == ',' {
+				// end of element (empty elements are allowed and ignored)
+				if !empty {
+					elements = append(elements, element)
+				}
+				element, empty = forwardedElement{}, true
+				i++
+				continue
+			}
+			if value[i] == ';' {
+				i++
+				continue
+			}
+			// read the pair's name
+			start := i
+			for i < len(value) && isTokenChar(value[i]) {
+				i++
+			}
+			if i == start || i == len(value) || value[i] != '=' {
+				return nil, fmt.Errorf("invalid Forwarded header %q, expected name=value pairs at position %d", value, start)
+			}
+			name := strings.ToLower(value[start:i])
+			i++
+			// read the pair's value (a token or a quoted string)
+			var v string
+			if i < len(value) && value[i] == '"' {
+				var b strings.Builder
+				i++
+				for ; i < len(value) && value[i] != '"'; i++ {
+					if value[i] == '\\' && i+1 < len(value) {
+						i++
+					}
+					b.WriteByte(value[i])
+				}
+				if i == len(value) {
+					return nil, fmt.Errorf("invalid Forwarded header %q, unterminated quoted string", value)
+				}
+				i++
+				v = b.String()
+			} else {
+				start = i
+				for i < len(value) && isTokenChar(value[i]) {
+					i++
+				}
+				v = value[start:i]
+			}
+			// the pair must be followed by the end of the element or another pair
+			for i < len(value) && (value[i] == ' ' || value[i] == '\t') {
+				i++
+			}
+			if i < len(value) && value[i] != ';' && value[i] != ',' {
+				return nil, fmt.Errorf("invalid Forwarded header %q, unexpected character %q at position %d", value, value[i], i)
+			}
+			switch name {
+			case "by":
+				element.By = v
+			case "for":
+				element.For = v
+			case "host":
+				element.Host = v
+			case "proto":
+				element.Proto = strings.ToLower(v)
+			}
+			empty = false
+		}
+	}
+	return elements, nil
+}
+
+// isTokenChar reports whether c is allowed in a token (https://tools.ietf.org/html/rfc7230#section-3.2.6)
+func isTokenChar(c byte) bool {
+	if c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// forwardedFor returns the `for` values of the elements of a Forwarded header in the form used
+// by the X-Forwarded-For header i.e. without any port or the brackets around an IPv6 address
+func forwardedFor(elements []forwardedElement) []string {
+	var forwardedFor []string
+	for _, element := range elements {
+		node := element.For
+		if node == "" {
+			continue
+		}
+		if host, _, err := net.SplitHostPort(node); err == nil {
+			node = host
+		}
+		node = strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+		forwardedFor = append(forwardedFor, node)
+	}
+	return forwardedFor
+}
+
+// applyForwarded works out the protocol and host used to send a part's request from its Forwarded header(s).
+// The first `proto` (which must be http or https) and `host` values are used, falling back to the part's Host header for the host
+// (the protocol is empty if there is no `proto` value).
+// Any `for` values are added to the X-Forwarded-For header of the part's request.
+// If the Forwarded header is invalid the returned error is accompanied by a machine-readable code for the reason.
+func applyForwarded(pr *http.Request) (protocol string, host string, code string, err error) {
+	elements, err := parseForwarded(pr.Header["Forwarded"])
+	if err != nil {
+		return "", "", "invalid_forwarded_header", err
+	}
+	host = pr.Host
+	hostOverridden := false
+	for _, element := range elements {
+		if protocol == "" && element.Proto != "" {
+			protocol = element.Proto
+		}
+		if !hostOverridden && element.Host != "" {
+			host, hostOverridden = element.Host, true
+		}
+	}
+	if protocol != "" && protocol != "http" && protocol != "https" {
+		err = fmt.Errorf("invalid proto value %s in Forwarded header, expected proto=http or proto=https", protocol)
+		return "", "", "invalid_forwarded_proto", err
+	}
+	if forwardedFor := forwardedFor(elements); len(forwardedFor) > 0 {
+		if existing := pr.Header.Get("X-Forwarded-For"); existing != "" {
+			forwardedFor = append([]string{existing}, forwardedFor...)
+		}
+		pr.Header.Set("X-Forwarded-For", strings.Join(forwardedFor, ", "))
+	}
+	return protocol, host, "", nil
+}
@@ -0,0 +1,105 @@
+package batch
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseForwarded(t *testing.T) {
+	t.Log("We should be able to parse Forwarded headers as per RFC 7239")
+	{
+		elements, err := parseForwarded([]string{
+			`for=1.2.3.4;proto=https, For="[2001:db8:cafe::17]:4711";by=proxy`,
+			`host="api.example.com";proto=HTTP`,
+		})
+		if err != nil {
+			t.Fatalf("\t\tShould parse the header, but received %s %v", err, cross)
+		}
+		if len(elements) == 3 {
+			t.Log("\t\tShould parse multiple elements across multiple header values", tick)
+		} else {
+			t.Fatalf("\t\tShould parse multiple elements across multiple header values, but received %v %v", elements, cross)
+		}
+		if elements[0].For == "1.2.3.4" && elements[0].Proto == "https" {
+			t.Log("\t\tShould parse the pairs of an element regardless of their order", tick)
+		} else {
+			t.Errorf("\t\tShould parse the pairs of an element regardless of their order, but received %v %v", elements[0], cross)
+		}
+		if elements[1].For == "[2001:db8:cafe::17]:4711" && elements[1].By == "proxy" && elements[2].Host == "api.example.com" {
+			t.Log("\t\tShould parse quoted values and case-insensitive names", tick)
+		} else {
+			t.Errorf("\t\tShould parse quoted values and case-insensitive names, but received %v and %v %v", elements[1], elements[2], cross)
+		}
+		if elements[2].Proto == "http" {
+			t.Log("\t\tShould treat the proto value as case-insensitive", tick)
+		} else {
+			t.Errorf("\t\tShould treat the proto value as case-insensitive, but received %q %v", elements[2].Proto, cross)
+		}
+	}
+
+	t.Log("We should not be able to parse invalid Forwarded headers")
+	{
+		for _, value := range []string{`proto`, `proto=http for=1.2.3.4`, `for="1.2.3.4`, `=http`} {
+			if _, err := parseForwarded([]string{value}); err != nil {
+				t.Logf("\t\tShould receive an error for %q %v", value, tick)
+			} else {
+				t.Errorf("\t\tShould receive an error for %q %v", value, cross)
+			}
+		}
+	}
+}
+
+func TestApplyForwarded(t *testing.T) {
+	newRequest := func(forwarded ...string) *http.Request {
+		r, _ := http.NewRequest("GET", "http://example.com/", nil)
+		r.Header["Forwarded"] = forwarded
+		return r
+	}
+
+	t.Log("We should be able to work out how to send a part's request from its Forwarded header")
+	{
+		r := newRequest(`for=1.2.3.4;proto=https;host=api.example.com`, `for="[2001:db8:cafe::17]:4711"`)
+		r.Header.Set("X-Forwarded-For", "10.0.0.1")
+		protocol, host, _, err := applyForwarded(r)
+		if err == nil && protocol == "https" {
+			t.Log("\t\tShould use the proto value", tick)
+		} else {
+			t.Errorf("\t\tShould use the proto value, but received %q %v %v", protocol, err, cross)
+		}
+		if host == "api.example.com" {
+			t.Log("\t\tShould use the host value instead of the Host header", tick)
+		} else {
+			t.Errorf("\t\tShould use the host value instead of the Host header, but received %q %v", host, cross)
+		}
+		if xff := r.Header.Get("X-Forwarded-For"); xff == "10.0.0.1, 1.2.3.4, 2001:db8:cafe::17" {
+			t.Log("\t\tShould add the for values to the X-Forwarded-For header", tick)
+		} else {
+			t.Errorf("\t\tShould add the for values to the X-Forwarded-For header, but received %q %v", xff, cross)
+		}
+	}
+
+	t.Log("We should fall back to the Host header when there is no host value")
+	{
+		protocol, host, _, err := applyForwarded(newRequest("proto=http"))
+		if err == nil && protocol == "http" && host == "example.com" {
+			t.Log("\t\tShould use the Host header", tick)
+		} else {
+			t.Errorf("\t\tShould use the Host header, but received %q %q %v %v", protocol, host, err, cross)
+		}
+	}
+
+	t.Log("We should receive an error code for invalid Forwarded headers")
+	{
+		for forwarded, expected := range map[string]string{
+			"proto=ftp":     "invalid_forwarded_proto",
+			`proto="http`:   "invalid_forwarded_header",
+			"proto=http;;x": "invalid_forwarded_header",
+		} {
+			if _, _, code, err := applyForwarded(newRequest(forwarded)); err != nil && code == expected {
+				t.Logf("\t\tShould receive %s for %q %v", expected, forwarded, tick)
+			} else {
+				t.Errorf("\t\tShould receive %s for %q, but received %q %v", expected, forwarded, code, cross)
+			}
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package batch
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/8legd/RRP/logging/elf"
+	"github.com/8legd/RRP/processors"
+)
+
+// harContentType is the media type of HAR (HTTP Archive) documents
+const harContentType = "application/har+json"
+
+// harDocument is an HTTP Archive as per HAR 1.2 (http://www.softwareishard.com/blog/har-12-spec/)
+// Only the fields used by RRP are included.
+type harDocument struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string         `json:"mimeType"`
+	Text     string         `json:"text"`
+	Params   []harNameValue `json:"params,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// harTimings are in milliseconds, with -1 for timings which do not apply
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// harSkippedHeaders are the headers of a HAR request which are not replayed as they are set for the request by RRP
+// (`Accept-Encoding` is skipped so responses are decompressed and can be returned as text)
+var harSkippedHeaders = map[string]bool{"Host": true, "Content-Length": true, "Connection": true, "Accept-Encoding": true}
+
+// newRequest converts the request of an entry in a HAR document into an *http.Request so it can be replayed
+func (hr *harRequest) newRequest() (*http.Request, error) {
+	if hr.URL == "" {
+		return nil, errors.New("missing url")
+	}
+	method := hr.Method
+	if method == "" {
+		method = "GET"
+	}
+	var body io.Reader
+	if hr.PostData != nil {
+		text := hr.PostData.Text
+		if text == "" && len(hr.PostData.Params) > 0 {
+			form := url.Values{}
+			for _, p := range hr.PostData.Params {
+				form.Add(p.Name, p.Value)
+			}
+			text = form.Encode()
+		}
+		if text != "" {
+			body = strings.NewReader(text)
+		}
+	}
+	request, err := http.NewRequest(method, hr.URL, body)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range hr.Headers {
+		// (HTTP/2 pseudo headers e.g. `:authority` are skipped along with those set by RRP)
+		name := http.CanonicalHeaderKey(h.Name)
+		if strings.HasPrefix(name, ":") || harSkippedHeaders[name] {
+			continue
+		}
+		request.Header.Add(name, h.Value)
+	}
+	if body != nil && request.Header.Get("Content-Type") == "" && hr.PostData.MimeType != "" {
+		request.Header.Set("Content-Type", hr.PostData.MimeType)
+	}
+	return request, nil
+}
+
+// acceptsHAR checks whether the `Accept` header of a batch request asks for the results as a HAR document
+func acceptsHAR(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mt, _, err := mime.ParseMediaType(strings.TrimSpace(accept)); err == nil && mt == harContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// harNameValues converts headers (or query string values) into HAR name/value pairs (sorted by name)
+func harNameValues(values map[string][]string) []harNameValue {
+	pairs := []harNameValue{}
+	for _, name := range sortedKeys(values) {
+		for _, v := range values[name] {
+			pairs = append(pairs, harNameValue{name, v})
+		}
+	}
+	return pairs
+}
+
+func sortedKeys(values map[string][]string) []string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// newHAREntry creates the entry in a HAR document for an individual request in a batch and its response.
+// The request can be nil if it could not be read, in which case its URL is used.
+// The started time is used for responses to requests which were not sent.
+func newHAREntry(request *http.Request, requestURL string, id string, response *processors.BatchedResponse, started time.Time) (harEntry, error) {
+	entry := harEntry{
+		Request: harRequest{
+			URL:         requestURL,
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameValue{},
+			Headers:     []harNameValue{},
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    0,
+		},
+		Comment: id,
+	}
+	if request != nil {
+		entry.Request.Method = request.Method
+		entry.Request.URL = request.URL.String()
+		if request.Proto != "" {
+			entry.Request.HTTPVersion = request.Proto
+		}
+		entry.Request.Headers = harNameValues(request.Header)
+		entry.Request.QueryString = harNameValues(request.URL.Query())
+		if request.GetBody != nil {
+			if rb, err := request.GetBody(); err == nil {
+				body, _ := ioutil.ReadAll(rb)
+				rb.Close()
+				if len(body) > 0 {
+					entry.Request.PostData = &harPostData{MimeType: request.Header.Get("Content-Type"), Text: string(body)}
+					entry.Request.BodySize = len(body)
+				}
+			}
+		}
+	}
+
+	if !response.Started.IsZero() {
+		started = response.Started
+	}
+	entry.StartedDateTime = started.Format(time.RFC3339Nano)
+	entry.Time = harMilliseconds(response.ProcessingDuration)
+	entry.Timings = newHARTimings(response)
+
+	statusText := strings.TrimSpace(strings.TrimPrefix(response.Status, strconv.Itoa(response.StatusCode)))
+	entry.Response = harResponse{
+		Status:      response.StatusCode,
+		StatusText:  statusText,
+		HTTPVersion: response.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     []harNameValue{},
+		HeadersSize: -1,
+	}
+	if response.Header != nil {
+		entry.Response.Headers = harNameValues(*response.Header)
+		entry.Response.Content.MimeType = response.Header.Get("Content-Type")
+		entry.Response.RedirectURL = response.Header.Get("Location")
+	}
+	if response.Body != nil {
+		body, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			return entry, err
+		}
+		entry.Response.Content.Size = len(body)
+		entry.Response.BodySize = len(body)
+		if utf8.Valid(body) {
+			entry.Response.Content.Text = string(body)
+		} else {
+			entry.Response.Content.Text = base64.StdEncoding.EncodeToString(body)
+			entry.Response.Content.Encoding = "base64"
+		}
+	}
+	return entry, nil
+}
+
+// newHARTimings converts the Timings of a response into HAR timings. As per HAR `connect` includes `ssl`,
+// phases which did not happen (e.g. for a reused connection) are -1 and `wait` is the rest of the time to the first byte.
+func newHARTimings(response *processors.BatchedResponse) harTimings {
+	t := response.Timings
+	if response.Started.IsZero() {
+		// (the request was not sent)
+		return harTimings{Blocked: -1, DNS: -1, Connect: -1, Send: 0, Wait: harMilliseconds(response.ProcessingDuration), Receive: 0, SSL: -1}
+	}
+	optional := func(d time.Duration) float64 {
+		if d == 0 {
+			return -1
+		}
+		return harMilliseconds(d)
+	}
+	wait := t.FirstByte - t.DNS - t.Connect - t.TLS
+	if wait < 0 || t.FirstByte == 0 {
+		// (the response was never received e.g. the request timed out)
+		wait = response.ProcessingDuration - t.DNS - t.Connect - t.TLS
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return harTimings{
+		Blocked: -1,
+		DNS:     optional(t.DNS),
+		Connect: optional(t.Connect + t.TLS),
+		Send:    0,
+		Wait:    harMilliseconds(wait),
+		Receive: harMilliseconds(t.Transfer),
+		SSL:     optional(t.TLS),
+	}
+}
+
+func harMilliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// writeHAR writes the results of a batch as a HAR document
+func writeHAR(w http.ResponseWriter, entries []harEntry, started time.Time, requestID string, handler string) {
+	if entries == nil {
+		entries = []harEntry{}
+	}
+	out, err := json.Marshal(harDocument{harLog{Version: "1.2", Creator: harCreator{Name: "RRP", Version: "1.0.1"}, Entries: entries}})
+	if err != nil {
+		elf.Log("ERROR", "Error whilst processing "+handler+" request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", harContentType+"; charset=utf-8")
+	w.Write(out)
+	elf.Log("INFO", "Completed handling of "+handler+" request", elf.LogOptions{Tags: requestID, Started: started})
+}
+
+// writeBatchHAR writes the results of a batch as a HAR document with an entry for each request (in the same sequence)
+func writeBatchHAR(w http.ResponseWriter, requests []*http.Request, urls []string, ids []string, responses []*processors.BatchedResponse, started time.Time, requestID string, handler string) {
+	entries := make([]harEntry, len(responses))
+	for i, response := range responses {
+		if response == nil {
+			err := errors.New("missing response for " + urls[i])
+			elf.Log("ERROR", "Error whilst processing "+handler+" request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logResponse(requestID, urls[i], response)
+		var err error
+		entries[i], err = newHAREntry(requests[i], urls[i], ids[i], response, started)
+		if err != nil {
+			elf.Log("ERROR", "Error whilst reading "+handler+" request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set(processors.ServerTimingHeader, serverTiming(started, responses))
+	writeHAR(w, entries, started, requestID, handler)
+}
+
+// HAR handles a batch of HTTP requests in HAR (HTTP Archive) format e.g. as exported by browser dev tools.
+// The request of each entry in the HAR document is replayed and the results are returned as a HAR document
+// with an entry for each request (in the same sequence) containing its response and timings.
+func HAR(w http.ResponseWriter, r *http.Request) {
+	started := time.Now()
+	requestID := "REQUEST_ID:" + r.Header.Get("x-request-id")
+	elf.Log("INFO", "Started handling of batch/har request", elf.LogOptions{Tags: requestID, Started: started})
+	// the response is compressed if the client accepts it (as per its `Accept-Encoding` header)
+	w, closeResponse := compressResponse(w, r)
+	defer closeResponse()
+	ct, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		handleError(w, started, requestID, http.StatusBadRequest, "Error parsing `Content-Type` header of batch/har request", err)
+		return
+	}
+	if ct != harContentType && ct != "application/json" {
+		err = errors.New("unsupported content type, expected application/har+json or application/json")
+		handleError(w, started, requestID, http.StatusBadRequest, "Error parsing `Content-Type` header of batch/har request", err)
+		return
+	}
+	// check for optional timeout header
+	timeout, ok := parseTimeout(w, r, started, requestID, "batch/har")
+	if !ok {
+		return
+	}
+	// check for optional mode header
+	mode, ok := parseMode(w, r, started, requestID, "batch/har")
+	if !ok {
+		return
+	}
+	// check for optional deadline header
+	deadline, ok := parseDeadline(w, r, started, requestID, "batch/har")
+	if !ok {
+		return
+	}
+	// check for optional header to pass compressed upstream responses through verbatim
+	keepEncoding, ok := parseFlag(w, r, started, requestID, "batch/har", "x-rrp-keep-encoding")
+	if !ok {
+		return
+	}
+
+	// Read request body - should be a HAR document - and process the batch
+	defer func() {
+		r.Body.Close()
+	}()
+	content, ok := limitRequest(w, r, started, requestID, "batch/har")
+	if !ok {
+		return
+	}
+	var document harDocument
+	err = json.NewDecoder(content).Decode(&document)
+	if le, ok := exceedsLimit(content, err); ok {
+		handleLimitError(w, started, requestID, "batch/har", le)
+		return
+	}
+	if err != nil {
+		elf.Log("ERROR", "Error parsing content of batch/har request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries := document.Log.Entries
+	if len(entries) < 1 {
+		err = errors.New("invalid HAR content, expected a log with one or more entries")
+		elf.Log("ERROR", "Error parsing content of batch/har request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = tooManyParts(len(entries)); err != nil {
+		handleLimitError(w, started, requestID, "batch/har", err.(*limitError))
+		return
+	}
+	// an entry which could not be read only fails its own response, the rest of the batch is still processed
+	requests := make([]*http.Request, len(entries))
+	responses := make([]*processors.BatchedResponse, len(entries))
+	options := processors.BatchOptions{Mode: mode, Deadline: deadline, KeepEncoding: keepEncoding}
+	for i := range entries {
+		code := "invalid_request"
+		requests[i], err = entries[i].Request.newRequest()
+		if err == nil {
+			code = "part_too_large"
+			err = partTooLarge(requests[i].ContentLength)
+		}
+		if err != nil {
+			elf.Log("ERROR", "Error reading individual request from content in batch/har request", elf.LogOptions{Tags: requestID, Payload: "index=" + strconv.Itoa(i) + " " + processors.ErrorCodeHeader + "=" + code, Cause: err, Started: started})
+			responses[i] = processors.ErrorResponse(i, "", partErrorStatus(code), code, fmt.Errorf("entry %d: %s", i, err.Error()))
+		}
+	}
+
+	err = processBatch(requests, responses, timeout, options, requestID, nil)
+	if err != nil {
+		elf.Log("ERROR", "Error processing batch from batch/har request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	urls := make([]string, len(entries))
+	ids := make([]string, len(entries))
+	for i := range entries {
+		urls[i], ids[i] = entries[i].Request.URL, entries[i].Comment
+	}
+	writeBatchHAR(w, requests, urls, ids, responses, started, requestID, "batch/har")
+}
@@ -0,0 +1,176 @@
+package batch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/8legd/RRP/processors"
+)
+
+func TestHAR(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("x-seen-encoding", r.Header.Get("Accept-Encoding"))
+		w.Write([]byte(r.Method + " " + r.URL.RequestURI() + " " + r.Header.Get("x-test") + string(body)))
+	}))
+	defer upstream.Close()
+
+	readHAR := func(t *testing.T, rec *httptest.ResponseRecorder) harDocument {
+		var document harDocument
+		if err := json.Unmarshal(rec.Body.Bytes(), &document); err != nil {
+			t.Fatalf("\t\tShould receive a HAR document, but received %d `%s` %v", rec.Code, rec.Body.String(), cross)
+		}
+		return document
+	}
+
+	t.Log("We should be able to replay the entries of a HAR document with batch/har")
+	{
+		content := `{"log": {"version": "1.2", "creator": {"name": "test", "version": "1"}, "entries": [
+			{"request": {"method": "GET", "url": "` + upstream.URL + `/first?a=1", "httpVersion": "HTTP/2",
+				"headers": [{"name": ":authority", "value": "example.com"}, {"name": "x-test", "value": "yes"}, {"name": "accept-encoding", "value": "br"}]}},
+			{"request": {"method": "POST", "url": "` + upstream.URL + `/second", "headers": [],
+				"postData": {"mimeType": "text/plain", "text": " posted"}}, "comment": "second"},
+			{"request": {"method": "GET", "url": ""}}
+		]}}`
+		req := httptest.NewRequest("POST", "/batch/har", strings.NewReader(content))
+		req.Header.Set("Content-Type", "application/har+json")
+		rec := httptest.NewRecorder()
+		HAR(rec, req)
+
+		document := readHAR(t, rec)
+		entries := document.Log.Entries
+		if rec.Header().Get("Content-Type") != "application/har+json; charset=utf-8" || document.Log.Version != "1.2" || len(entries) != 3 {
+			t.Fatalf("\t\tShould receive a HAR log with 3 entries, but received `%s` %v", rec.Body.String(), cross)
+		}
+		t.Log("\t\tShould receive a HAR log with 3 entries", tick)
+		if entries[0].Response.Status == http.StatusOK && entries[0].Response.Content.Text == "GET /first?a=1 yes" &&
+			entries[0].Response.Content.MimeType == "text/plain" && entries[1].Response.Content.Text == "POST /second  posted" {
+			t.Log("\t\tShould receive the response to each entry's request", tick)
+		} else {
+			t.Errorf("\t\tShould receive the response to each entry's request, but received %+v and %+v %v", entries[0].Response, entries[1].Response, cross)
+		}
+		if entries[0].Request.HTTPVersion == "HTTP/1.1" && entries[0].Request.QueryString[0] == (harNameValue{"a", "1"}) &&
+			entries[1].Request.PostData != nil && entries[1].Request.PostData.Text == " posted" && entries[1].Comment == "second" {
+			t.Log("\t\tShould receive each request as it was sent", tick)
+		} else {
+			t.Errorf("\t\tShould receive each request as it was sent, but received %+v and %+v %v", entries[0].Request, entries[1].Request, cross)
+		}
+		seen := ""
+		for _, h := range entries[0].Response.Headers {
+			if h.Name == "X-Seen-Encoding" {
+				seen = h.Value
+			}
+		}
+		if seen == "gzip" {
+			t.Log("\t\tShould not replay the `Accept-Encoding` header of a request", tick)
+		} else {
+			t.Errorf("\t\tShould not replay the `Accept-Encoding` header of a request, but upstream received %q %v", seen, cross)
+		}
+		if entries[0].StartedDateTime != "" && entries[0].Time > 0 && entries[0].Timings.Wait > 0 && entries[0].Timings.DNS == -1 && entries[0].Timings.SSL == -1 {
+			t.Log("\t\tShould receive the timings of each entry", tick)
+		} else {
+			t.Errorf("\t\tShould receive the timings of each entry, but received %+v %v", entries[0], cross)
+		}
+		if entries[2].Response.Status == http.StatusBadRequest {
+			t.Log("\t\tShould receive an error response for an invalid entry", tick)
+		} else {
+			t.Errorf("\t\tShould receive an error response for an invalid entry, but received %+v %v", entries[2].Response, cross)
+		}
+	}
+
+	t.Log("We should not be able to make requests to batch/har without entries")
+	{
+		req := httptest.NewRequest("POST", "/batch/har", strings.NewReader(`{"log": {"entries": []}}`))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		HAR(rec, req)
+		if rec.Code == http.StatusBadRequest {
+			t.Log("\t\tShould receive a 400 response", tick)
+		} else {
+			t.Errorf("\t\tShould receive a 400 response, but received %d %v", rec.Code, cross)
+		}
+	}
+
+	t.Log("We should be able to receive the results of batch/json as a HAR document")
+	{
+		content := `[{"id": "one", "url": "` + upstream.URL + `/one"}, {"url": "` + upstream.URL + `/two", "method": "PUT", "body": "2"}]`
+		req := httptest.NewRequest("POST", "/batch/json", strings.NewReader(content))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json;q=0.5, application/har+json")
+		rec := httptest.NewRecorder()
+		JSON(rec, req)
+
+		entries := readHAR(t, rec).Log.Entries
+		if len(entries) == 2 && entries[0].Comment == "one" && entries[0].Response.Content.Text == "GET /one " &&
+			entries[1].Request.Method == "PUT" && entries[1].Response.Content.Text == "PUT /two 2" {
+			t.Log("\t\tShould receive an entry for each request in the same sequence", tick)
+		} else {
+			t.Errorf("\t\tShould receive an entry for each request in the same sequence, but received `%s` %v", rec.Body.String(), cross)
+		}
+	}
+
+	t.Log("We should be able to receive the results of batch/multipartmixed as a HAR document")
+	{
+		content := "--b\r\nContent-Type: application/http\r\nContent-ID: <one>\r\n\r\n" +
+			"GET " + upstream.URL + "/one HTTP/1.1\r\n\r\n\r\n" +
+			"--b\r\nContent-Type: multipart/mixed; boundary=c\r\n\r\n" +
+			"--c\r\nContent-Type: application/http\r\n\r\n" +
+			"GET " + upstream.URL + "/two HTTP/1.1\r\n\r\n\r\n" +
+			"--c--\r\n" +
+			"--b--\r\n"
+		req := httptest.NewRequest("POST", "/batch/multipartmixed", strings.NewReader(content))
+		req.Header.Set("Content-Type", "multipart/mixed; boundary=b")
+		req.Header.Set("Accept", "application/har+json")
+		req.Header.Set("x-rrp-stream", "true")
+		rec := httptest.NewRecorder()
+		MultipartMixed(rec, req)
+
+		entries := readHAR(t, rec).Log.Entries
+		if len(entries) == 2 && entries[0].Comment == "one" && entries[0].Response.Content.Text == "GET /one " &&
+			entries[1].Response.Content.Text == "GET /two " {
+			t.Log("\t\tShould receive an entry for each request including those in changesets", tick)
+		} else {
+			t.Errorf("\t\tShould receive an entry for each request including those in changesets, but received `%s` %v", rec.Body.String(), cross)
+		}
+	}
+
+	t.Log("We should be able to receive the results of batch/ndjson as a HAR document")
+	{
+		content := `{"url": "` + upstream.URL + `/one"}` + "\n" + `{"url": "` + upstream.URL + `/two"}` + "\n"
+		req := httptest.NewRequest("POST", "/batch/ndjson", strings.NewReader(content))
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		req.Header.Set("Accept", "application/har+json")
+		rec := httptest.NewRecorder()
+		NDJSON(rec, req)
+
+		entries := readHAR(t, rec).Log.Entries
+		if len(entries) == 2 && entries[0].Response.Content.Text == "GET /one " && entries[1].Response.Content.Text == "GET /two " {
+			t.Log("\t\tShould receive an entry for each request in the same sequence", tick)
+		} else {
+			t.Errorf("\t\tShould receive an entry for each request in the same sequence, but received `%s` %v", rec.Body.String(), cross)
+		}
+	}
+
+	t.Log("We should receive a 413 (Request Entity Too Large) once the HAR document for batch/ndjson is too large")
+	{
+		processors.MaxResponseSize = 20
+		defer func() { processors.MaxResponseSize = 0 }()
+		content := strings.Repeat(`{"url": "`+upstream.URL+`/item"}`+"\n", 10)
+		req := httptest.NewRequest("POST", "/batch/ndjson", strings.NewReader(content))
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		req.Header.Set("Accept", "application/har+json")
+		req.Header.Set("x-rrp-mode", "sequential")
+		rec := httptest.NewRecorder()
+		NDJSON(rec, req)
+		if rec.Code == http.StatusRequestEntityTooLarge {
+			t.Log("\t\tShould stop collecting the entries of the HAR document", tick)
+		} else {
+			t.Errorf("\t\tShould stop collecting the entries of the HAR document, but received %d `%s` %v", rec.Code, rec.Body.String(), cross)
+		}
+	}
+}
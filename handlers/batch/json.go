@@ -0,0 +1,284 @@
+package batch
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/8legd/RRP/logging/elf"
+	"github.com/8legd/RRP/processors"
+)
+
+// jsonHeader holds the headers of an individual request in a batch/json request.
+// Header values can be given either as a single string or as an array of strings.
+type jsonHeader http.Header
+
+func (h *jsonHeader) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	header := make(http.Header)
+	for k, v := range raw {
+		var single string
+		if err := json.Unmarshal(v, &single); err == nil {
+			header.Add(k, single)
+			continue
+		}
+		var multiple []string
+		if err := json.Unmarshal(v, &multiple); err != nil {
+			return fmt.Errorf("invalid value for header %s, expected a string or an array of strings", k)
+		}
+		for _, s := range multiple {
+			header.Add(k, s)
+		}
+	}
+	*h = jsonHeader(header)
+	return nil
+}
+
+// jsonRequest is an individual request in a batch/json request
+type jsonRequest struct {
+	ID           string     `json:"id"`
+	DependsOn    []string   `json:"dependsOn"`
+	Method       string     `json:"method"`
+	URL          string     `json:"url"`
+	Headers      jsonHeader `json:"headers"`
+	Body         string     `json:"body"`
+	BodyEncoding string     `json:"bodyEncoding"`
+}
+
+// jsonResponse is an individual response in a batch/json response
+type jsonResponse struct {
+	ID           string      `json:"id,omitempty"`
+	Status       string      `json:"status"`
+	StatusCode   int         `json:"statusCode"`
+	Headers      http.Header `json:"headers"`
+	Body         string      `json:"body"`
+	BodyEncoding string      `json:"bodyEncoding,omitempty"`
+	DurationMs   float64     `json:"durationMs"`
+}
+
+// newRequest converts an individual request from a batch/json request into an *http.Request
+// Bodies with a `bodyEncoding` of `base64` are decoded before being sent
+func (jr *jsonRequest) newRequest() (*http.Request, error) {
+	if jr.URL == "" {
+		return nil, errors.New("missing url")
+	}
+	method := jr.Method
+	if method == "" {
+		method = "GET"
+	}
+	var body []byte
+	switch jr.BodyEncoding {
+	case "":
+		body = []byte(jr.Body)
+	case "base64":
+		var err error
+		body, err = base64.StdEncoding.DecodeString(jr.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 body: %s", err.Error())
+		}
+	default:
+		return nil, fmt.Errorf("unsupported bodyEncoding %q, expected base64", jr.BodyEncoding)
+	}
+	var br io.Reader
+	if len(body) > 0 {
+		br = bytes.NewReader(body)
+	}
+	request, err := http.NewRequest(method, jr.URL, br)
+	if err != nil {
+		return nil, err
+	}
+	if jr.Headers != nil {
+		request.Header = http.Header(jr.Headers)
+	}
+	return request, nil
+}
+
+// newJSONResponse converts a BatchedResponse into an individual response of a batch/json response
+// Bodies which are not valid UTF-8 text are returned base64 encoded with a `bodyEncoding` of `base64`
+func newJSONResponse(br *processors.BatchedResponse) (*jsonResponse, error) {
+	jr := &jsonResponse{
+		Status:     br.Status,
+		StatusCode: br.StatusCode,
+		Headers:    http.Header{},
+		DurationMs: float64(br.ProcessingDuration) / float64(time.Millisecond),
+	}
+	if br.Header != nil {
+		jr.Headers = *br.Header
+	}
+	if br.Body != nil {
+		pb, err := ioutil.ReadAll(br.Body)
+		if err != nil {
+			return nil, err
+		}
+		if utf8.Valid(pb) {
+			jr.Body = string(pb)
+		} else {
+			jr.Body = base64.StdEncoding.EncodeToString(pb)
+			jr.BodyEncoding = "base64"
+		}
+	}
+	return jr, nil
+}
+
+// JSON handles a batch of HTTP requests in `application/json` format.
+// The content is an array of request objects e.g. `{"method": "GET", "url": "https://www.example.com/", "headers": {}, "body": ""}`
+// Once processed, HTTP responses are returned as an array of response objects
+// e.g. `{"status": "200 OK", "statusCode": 200, "headers": {}, "body": "", "durationMs": 12.3}`
+// in the same sequence as the corresponding requests.
+func JSON(w http.ResponseWriter, r *http.Request) {
+	started := time.Now()
+	requestID := "REQUEST_ID:" + r.Header.Get("x-request-id")
+	elf.Log("INFO", "Started handling of batch/json request", elf.LogOptions{Tags: requestID, Started: started})
+	// the response is compressed if the client accepts it (as per its `Accept-Encoding` header)
+	w, closeResponse := compressResponse(w, r)
+	defer closeResponse()
+	ct, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		handleError(w, started, requestID, http.StatusBadRequest, "Error parsing `Content-Type` header of batch/json request", err)
+		return
+	}
+	if ct != "application/json" {
+		err = errors.New("unsupported content type, expected application/json")
+		handleError(w, started, requestID, http.StatusBadRequest, "Error parsing `Content-Type` header of batch/json request", err)
+		return
+	}
+	// check for optional timeout header
+	timeout, ok := parseTimeout(w, r, started, requestID, "batch/json")
+	if !ok {
+		return
+	}
+	// check for optional mode header
+	mode, ok := parseMode(w, r, started, requestID, "batch/json")
+	if !ok {
+		return
+	}
+	// check for optional deadline header
+	deadline, ok := parseDeadline(w, r, started, requestID, "batch/json")
+	if !ok {
+		return
+	}
+	// check for optional header to pass compressed upstream responses through verbatim
+	keepEncoding, ok := parseFlag(w, r, started, requestID, "batch/json", "x-rrp-keep-encoding")
+	if !ok {
+		return
+	}
+
+	// Read request body - should be an array of requests - and process the batch
+	defer func() {
+		r.Body.Close()
+	}()
+
+	content, ok := limitRequest(w, r, started, requestID, "batch/json")
+	if !ok {
+		return
+	}
+	var jsonRequests []jsonRequest
+	err = json.NewDecoder(content).Decode(&jsonRequests)
+	if le, ok := exceedsLimit(content, err); ok {
+		handleLimitError(w, started, requestID, "batch/json", le)
+		return
+	}
+	if err != nil {
+		elf.Log("ERROR", "Error parsing content of batch/json request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(jsonRequests) < 1 {
+		err = errors.New("invalid json content, expected an array of one or more requests")
+		elf.Log("ERROR", "Error parsing content of batch/json request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = tooManyParts(len(jsonRequests)); err != nil {
+		handleLimitError(w, started, requestID, "batch/json", err.(*limitError))
+		return
+	}
+	// a request which could not be read only fails its own response, the rest of the batch is still processed
+	requests := make([]*http.Request, len(jsonRequests))
+	urls := make([]string, len(jsonRequests))
+	responses := make([]*processors.BatchedResponse, len(jsonRequests))
+	ids := make([]string, len(jsonRequests))
+	for i := range jsonRequests {
+		ids[i] = jsonRequests[i].ID
+	}
+	options := processors.BatchOptions{Mode: mode, Deadline: deadline, KeepEncoding: keepEncoding, Parts: make([]processors.PartOptions, len(jsonRequests))}
+	for i := range jsonRequests {
+		urls[i] = jsonRequests[i].URL
+		options.Parts[i].ID = ids[i]
+		code := "invalid_request"
+		requests[i], err = jsonRequests[i].newRequest()
+		if err == nil {
+			code = "part_too_large"
+			err = partTooLarge(requests[i].ContentLength)
+		}
+		if err == nil {
+			// the request can have its own timeout specified with a `x-rrp-timeout` header
+			code = "invalid_timeout"
+			options.Parts[i].Timeout, err = partTimeout(requests[i].Header)
+		}
+		if err == nil {
+			code = "invalid_dependency"
+			options.Parts[i].DependsOn, err = dependencies(i, jsonRequests[i].DependsOn, ids)
+		}
+		if err != nil {
+			elf.Log("ERROR", "Error reading individual request from content in batch/json request", elf.LogOptions{Tags: requestID, Payload: "index=" + strconv.Itoa(i) + " " + processors.ErrorCodeHeader + "=" + code, Cause: err, Started: started})
+			responses[i] = processors.ErrorResponse(i, "", partErrorStatus(code), code, err)
+		}
+	}
+
+	err = processBatch(requests, responses, timeout, options, requestID, nil)
+	if err != nil {
+		elf.Log("ERROR", "Error processing batch from batch/json request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// the results are returned as a HAR document if the client asks for one (as per its `Accept` header)
+	if acceptsHAR(r) {
+		writeBatchHAR(w, requests, urls, ids, responses, started, requestID, "batch/json")
+		return
+	}
+
+	jsonResponses := make([]*jsonResponse, len(responses))
+	for i, response := range responses {
+		if response == nil {
+			err = errors.New("missing response for " + urls[i])
+			elf.Log("ERROR", "Error whilst processing batch/json request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logResponse(requestID, urls[i], response)
+		jsonResponses[i], err = newJSONResponse(response)
+		if err != nil {
+			elf.Log("ERROR", "Error whilst reading batch/json request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// the request's optional id is echoed back on its response so clients can correlate them
+		jsonResponses[i].ID = jsonRequests[i].ID
+	}
+
+	// (We need to buffer this in case there is an error. If we didn't and wrote
+	// directly to the response stream it would implicitly set a status of 200 OK)
+	out, err := json.Marshal(jsonResponses)
+	if err != nil {
+		elf.Log("ERROR", "Error whilst processing batch/json request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set(processors.ServerTimingHeader, serverTiming(started, responses))
+	w.Write(out)
+	elf.Log("INFO", "Completed handling of batch/json request", elf.LogOptions{Tags: requestID, Started: started})
+}
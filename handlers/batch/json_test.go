@@ -0,0 +1,99 @@
+package batch
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const tick = "\u2713"
+const cross = "\u2717"
+
+func TestJSON(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("x-method", r.Method)
+		w.Write(body)
+	}))
+	defer upstream.Close()
+
+	t.Log("We should be able to make requests to batch/json")
+	{
+		binary := []byte{0xff, 0xfe, 0x00, 0x01}
+		content := `[
+			{"method": "POST", "url": "` + upstream.URL + `/text", "headers": {"Content-Type": "text/plain"}, "body": "Hello Bob"},
+			{"method": "PUT", "url": "` + upstream.URL + `/binary", "headers": {"Content-Type": ["application/octet-stream"]}, "body": "` + base64.StdEncoding.EncodeToString(binary) + `", "bodyEncoding": "base64"}
+		]`
+		req := httptest.NewRequest("POST", "/batch/json", bytes.NewBufferString(content))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		JSON(rec, req)
+
+		var responses []jsonResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &responses); err != nil || len(responses) != 2 {
+			t.Fatalf("\t\tShould receive an array of 2 responses, but received `%s` %v", rec.Body.String(), cross)
+		}
+		t.Log("\t\tShould receive an array of 2 responses", tick)
+
+		if responses[0].StatusCode == http.StatusOK && responses[0].Body == "Hello Bob" && responses[0].Headers.Get("x-method") == "POST" {
+			t.Log("\t\tShould receive text bodies as is", tick)
+		} else {
+			t.Errorf("\t\tShould receive text bodies as is, but received %+v %v", responses[0], cross)
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(responses[1].Body)
+		if err == nil && responses[1].BodyEncoding == "base64" && bytes.Equal(decoded, binary) && responses[1].Headers.Get("x-method") == "PUT" {
+			t.Log("\t\tShould receive binary bodies base64 encoded", tick)
+		} else {
+			t.Errorf("\t\tShould receive binary bodies base64 encoded, but received %+v %v", responses[1], cross)
+		}
+
+		if strings.Contains(responses[0].Headers.Get("Server-Timing"), "ttfb;dur=") && strings.Contains(rec.Header().Get("Server-Timing"), "total;dur=") {
+			t.Log("\t\tShould receive the timings of each response and a summary for the batch", tick)
+		} else {
+			t.Errorf("\t\tShould receive the timings of each response and a summary for the batch, but received %q and %q %v", responses[0].Headers.Get("Server-Timing"), rec.Header().Get("Server-Timing"), cross)
+		}
+	}
+
+	t.Log("We should only be able to depend on earlier requests in batch/json")
+	{
+		content := `[
+			{"url": "` + upstream.URL + `/first", "dependsOn": ["second"]},
+			{"id": "second", "url": "` + upstream.URL + `/second"}
+		]`
+		req := httptest.NewRequest("POST", "/batch/json", bytes.NewBufferString(content))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		JSON(rec, req)
+
+		var responses []jsonResponse
+		json.Unmarshal(rec.Body.Bytes(), &responses)
+		if len(responses) == 2 && responses[0].StatusCode == http.StatusBadRequest && responses[0].Headers.Get("x-rrp-error-code") == "invalid_dependency" &&
+			responses[1].StatusCode == http.StatusOK {
+			t.Log("\t\tShould receive an invalid_dependency error response for a dependency on a later request", tick)
+		} else {
+			t.Errorf("\t\tShould receive an invalid_dependency error response for a dependency on a later request, but received `%s` %v", rec.Body.String(), cross)
+		}
+	}
+
+	t.Log("We should receive a 400 (Bad Request) for an invalid timeout")
+	{
+		for _, timeout := range []string{"0", "-1", "soon"} {
+			req := httptest.NewRequest("POST", "/batch/json", bytes.NewBufferString(`[{"url": "`+upstream.URL+`/text"}]`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("x-rrp-timeout", timeout)
+			rec := httptest.NewRecorder()
+			JSON(rec, req)
+			if rec.Code == http.StatusBadRequest {
+				t.Logf("\t\tShould receive a 400 (Bad Request) for x-rrp-timeout: %s %v", timeout, tick)
+			} else {
+				t.Errorf("\t\tShould receive a 400 (Bad Request) for x-rrp-timeout: %s, but received %d %v", timeout, rec.Code, cross)
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package batch
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/8legd/RRP/logging/elf"
+)
+
+// Limits on the size of batch requests, zero (the default) means no limit
+// (the maximum size of the responses buffered for a batch is limited by processors.MaxResponseSize)
+var (
+	// MaxParts is the maximum number of parts in a batch (for batch/multipartmixed requests this includes any changesets and the parts nested within them)
+	MaxParts int
+	// MaxPartBodySize is the maximum size in bytes of the body of an individual request in a batch
+	MaxPartBodySize int64
+	// MaxRequestSize is the maximum size in bytes of the content of a batch request
+	MaxRequestSize int64
+)
+
+// limitError is the error for a batch request which exceeds one of the limits
+type limitError struct {
+	error
+}
+
+// limitedReader reads the content of a batch request failing with a limitError once more than MaxRequestSize bytes have been read
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// (check there is more content rather than failing a request of exactly MaxRequestSize bytes)
+		if n, err := l.r.Read(make([]byte, 1)); n == 0 {
+			return 0, err
+		}
+		l.exceeded = true
+		return 0, &limitError{fmt.Errorf("batch request exceeds the maximum size of %d bytes", MaxRequestSize)}
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// limitRequest checks a batch request against MaxRequestSize returning its content limited to MaxRequestSize bytes.
+// If its Content-Length already exceeds the limit a 413 (Request Entity Too Large) is sent and ok is false.
+func limitRequest(w http.ResponseWriter, r *http.Request, started time.Time, requestID string, handler string) (content io.Reader, ok bool) {
+	if MaxRequestSize <= 0 {
+		return r.Body, true
+	}
+	if r.ContentLength > MaxRequestSize {
+		err := &limitError{fmt.Errorf("batch request of %d bytes exceeds the maximum size of %d bytes", r.ContentLength, MaxRequestSize)}
+		handleLimitError(w, started, requestID, handler, err)
+		return nil, false
+	}
+	return &limitedReader{r: r.Body, remaining: MaxRequestSize}, true
+}
+
+// exceedsLimit checks whether an error reading the content of a batch request was caused by it exceeding one of the limits
+// returning the limitError if so (the content is as returned by limitRequest)
+func exceedsLimit(content io.Reader, err error) (*limitError, bool) {
+	if l, ok := content.(*limitedReader); ok && l.exceeded {
+		return &limitError{fmt.Errorf("batch request exceeds the maximum size of %d bytes", MaxRequestSize)}, true
+	}
+	var le *limitError
+	if errors.As(err, &le) {
+		return le, true
+	}
+	return nil, false
+}
+
+// tooManyParts returns a limitError if the number of parts in a batch exceeds MaxParts
+func tooManyParts(parts int) error {
+	if MaxParts > 0 && parts > MaxParts {
+		return &limitError{fmt.Errorf("batch request exceeds the maximum of %d parts", MaxParts)}
+	}
+	return nil
+}
+
+// partTooLarge returns an error if the size of the body of an individual request in a batch exceeds MaxPartBodySize
+func partTooLarge(size int64) error {
+	if MaxPartBodySize > 0 && size > MaxPartBodySize {
+		return fmt.Errorf("request body exceeds the maximum size of %d bytes", MaxPartBodySize)
+	}
+	return nil
+}
+
+// partErrorStatus returns the status code for the error response of an individual request in a batch which could not be read
+func partErrorStatus(code string) int {
+	if code == "part_too_large" {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// handleLimitError logs a batch request which exceeds one of the limits and sends a 413 (Request Entity Too Large)
+func handleLimitError(w http.ResponseWriter, started time.Time, requestID string, handler string, err *limitError) {
+	elf.Log("ERROR", "Limit exceeded by "+handler+" request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
+	http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+}
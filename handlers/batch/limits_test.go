@@ -0,0 +1,112 @@
+package batch
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/8legd/RRP/processors"
+)
+
+func TestLimits(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer upstream.Close()
+	defer func() {
+		MaxParts, MaxPartBodySize, MaxRequestSize, processors.MaxResponseSize = 0, 0, 0, 0
+	}()
+	part := func(body string) string {
+		return "POST " + upstream.URL + "/ HTTP/1.1\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+	}
+
+	t.Log("We should receive a 413 (Request Entity Too Large) for a batch with too many parts")
+	{
+		MaxParts = 2
+		rec := postMultipartMixed(t, nil, part("a"), changeset(t, part("b"), part("c")))
+		if rec.Code == http.StatusRequestEntityTooLarge {
+			t.Log("\t\tShould count the parts nested in changesets", tick)
+		} else {
+			t.Errorf("\t\tShould count the parts nested in changesets, but received %d %v", rec.Code, cross)
+		}
+		req := httptest.NewRequest("POST", "/batch/json", strings.NewReader(`[{"url": "`+upstream.URL+`"}, {"url": "`+upstream.URL+`"}, {"url": "`+upstream.URL+`"}]`))
+		req.Header.Set("Content-Type", "application/json")
+		rec = httptest.NewRecorder()
+		JSON(rec, req)
+		if rec.Code == http.StatusRequestEntityTooLarge {
+			t.Log("\t\tShould count the requests of a batch/json request", tick)
+		} else {
+			t.Errorf("\t\tShould count the requests of a batch/json request, but received %d %v", rec.Code, cross)
+		}
+		MaxParts = 0
+	}
+
+	t.Log("We should receive a 413 (Request Entity Too Large) for a batch which is too large")
+	{
+		content, boundary := writeMultipartMixed(t, part(strings.Repeat("a", 100)), part(strings.Repeat("b", 100)))
+		MaxRequestSize = int64(len(content)) - 1
+		for _, contentLength := range []int64{int64(len(content)), -1} {
+			req := httptest.NewRequest("POST", "/batch/multipartmixed", bytes.NewReader(content))
+			req.Header.Set("Content-Type", "multipart/mixed; boundary="+boundary)
+			req.ContentLength = contentLength
+			rec := httptest.NewRecorder()
+			MultipartMixed(rec, req)
+			if rec.Code == http.StatusRequestEntityTooLarge {
+				t.Logf("\t\tShould check the content with a Content-Length of %d %v", contentLength, tick)
+			} else {
+				t.Errorf("\t\tShould check the content with a Content-Length of %d, but received %d %v", contentLength, rec.Code, cross)
+			}
+		}
+		MaxRequestSize = int64(len(content))
+		rec := postMultipartMixed(t, nil, part(strings.Repeat("a", 100)), part(strings.Repeat("b", 100)))
+		if rec.Code == http.StatusOK {
+			t.Log("\t\tShould accept a batch of exactly the maximum size", tick)
+		} else {
+			t.Errorf("\t\tShould accept a batch of exactly the maximum size, but received %d %v", rec.Code, cross)
+		}
+		MaxRequestSize = 0
+	}
+
+	t.Log("We should receive a 413 (Request Entity Too Large) for an individual request which is too large")
+	{
+		MaxPartBodySize = 5
+		responses := readMultipartMixed(t, postMultipartMixed(t, nil, part("Alice"), part("Robert")))
+		if len(responses) == 2 && responses[0].StatusCode == http.StatusOK &&
+			responses[1].StatusCode == http.StatusRequestEntityTooLarge && responses[1].Header.Get(processors.ErrorCodeHeader) == "part_too_large" {
+			t.Log("\t\tShould only fail the part which is too large", tick)
+		} else {
+			t.Errorf("\t\tShould only fail the part which is too large, but received %d responses %v", len(responses), cross)
+		}
+		req := httptest.NewRequest("POST", "/batch/json", strings.NewReader(`[{"method": "POST", "url": "`+upstream.URL+`", "body": "Alice"}, {"method": "POST", "url": "`+upstream.URL+`", "body": "Robert"}]`))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		JSON(rec, req)
+		var jsonResponses []jsonResponse
+		json.Unmarshal(rec.Body.Bytes(), &jsonResponses)
+		if len(jsonResponses) == 2 && jsonResponses[0].StatusCode == http.StatusOK && jsonResponses[1].StatusCode == http.StatusRequestEntityTooLarge {
+			t.Log("\t\tShould only fail the batch/json request which is too large", tick)
+		} else {
+			t.Errorf("\t\tShould only fail the batch/json request which is too large, but received %s %v", rec.Body.String(), cross)
+		}
+		MaxPartBodySize = 0
+	}
+
+	t.Log("We should receive an error response for an individual response which is too large")
+	{
+		processors.MaxResponseSize = 5
+		responses := readMultipartMixed(t, postMultipartMixed(t, nil, part("Alice"), part("Robert")))
+		if len(responses) == 2 && responses[0].StatusCode == http.StatusOK &&
+			responses[1].StatusCode == http.StatusBadGateway && responses[1].Header.Get(processors.ErrorCodeHeader) == "response_too_large" {
+			t.Log("\t\tShould only fail the response which is too large", tick)
+		} else {
+			t.Errorf("\t\tShould only fail the response which is too large, but received %d responses %v", len(responses), cross)
+		}
+		processors.MaxResponseSize = 0
+	}
+}
@@ -19,21 +19,19 @@ import (
 	"github.com/8legd/RRP/processors"
 )
 
-func handleError(w http.ResponseWriter, started time.Time, requestID string, statusCode int, errMsg string, cause error) {
-	elf.Log("ERROR", errMsg, elf.LogOptions{Tags: requestID, Cause: cause, Started: started})
-	http.Error(w, errMsg, statusCode)
-}
-
 // MultipartMixed handles a batch of HTTP requests in `multipart/mixed` format.
-// Each part contains `application/http` content representing an individual request.
+// Each part contains `application/http` content representing an individual request
+// or nested `multipart/mixed` content representing a changeset (as per OData).
 // Once processed, HTTP responses are returned as `application/http` content in
-// the same sequence as the corresponding requests.
+// the same sequence (and nested structure) as the corresponding requests.
 func MultipartMixed(w http.ResponseWriter, r *http.Request) {
 	started := time.Now()
 	requestID := "REQUEST_ID:" + r.Header.Get("x-request-id")
 	elf.Log("INFO", "Started handling of batch/multipartmixed request", elf.LogOptions{Tags: requestID, Started: started})
+	// the response is compressed if the client accepts it (as per its `Accept-Encoding` header)
+	w, closeResponse := compressResponse(w, r)
+	defer closeResponse()
 	stepErrMsg := "Error parsing `Content-Type` header of batch/multipartmixed request"
-	var batch []*http.Request
 	ct, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
 	if err != nil {
 		handleError(w, started, requestID, http.StatusBadRequest, stepErrMsg, err)
@@ -51,20 +49,37 @@ func MultipartMixed(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// check for optional timeout header
-	tm := r.Header.Get("x-rrp-timeout")
-	var timeout time.Duration
-	if tm != "" {
-		timeout, err = time.ParseDuration(tm + "s")
-		if err != nil {
-			elf.Log("ERROR", "Error parsing `x-rrp-timeout` header of batch/multipartmixed request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
-			http.Error(w, "invalid value for x-rrp-timeout header, expected number of seconds", http.StatusBadRequest)
-			return
-		}
-		elf.Log("INFO", "Timeout as specified in request is "+strconv.FormatFloat(timeout.Seconds(), 'f', 3, 64), elf.LogOptions{Tags: requestID, Started: started})
-
-	} else {
-		timeout = processors.DefaultTimeout // Default timeout
-		elf.Log("INFO", "Timeout used is default value of "+strconv.FormatFloat(timeout.Seconds(), 'f', 3, 64), elf.LogOptions{Tags: requestID, Started: started})
+	timeout, ok := parseTimeout(w, r, started, requestID, "batch/multipartmixed")
+	if !ok {
+		return
+	}
+	// check for optional mode header
+	mode, ok := parseMode(w, r, started, requestID, "batch/multipartmixed")
+	if !ok {
+		return
+	}
+	// check for optional deadline header
+	deadline, ok := parseDeadline(w, r, started, requestID, "batch/multipartmixed")
+	if !ok {
+		return
+	}
+	// check for optional streaming header
+	stream, ok := parseFlag(w, r, started, requestID, "batch/multipartmixed", "x-rrp-stream")
+	if !ok {
+		return
+	}
+	// check for optional header to pass compressed upstream responses through verbatim
+	keepEncoding, ok := parseFlag(w, r, started, requestID, "batch/multipartmixed", "x-rrp-keep-encoding")
+	if !ok {
+		return
+	}
+	// check for optional header to compress the individual response parts
+	partEncoding := strings.ToLower(r.Header.Get("x-rrp-part-encoding"))
+	if partEncoding != "" && partEncoding != "gzip" && partEncoding != "deflate" {
+		err = fmt.Errorf("unsupported part encoding %s", partEncoding)
+		elf.Log("ERROR", "Error parsing `x-rrp-part-encoding` header of batch/multipartmixed request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
+		http.Error(w, "invalid value for x-rrp-part-encoding header, expected gzip or deflate", http.StatusBadRequest)
+		return
 	}
 
 	// Read request body - should be multipart content - and process the batch
@@ -72,86 +87,51 @@ func MultipartMixed(w http.ResponseWriter, r *http.Request) {
 		r.Body.Close()
 	}()
 
-	mr := multipart.NewReader(r.Body, boundary)
-	var urls []string
-	for {
-		p, err := mr.NextPart()
-		if err == io.EOF {
-			if len(batch) < 1 {
-				err = errors.New("invalid multipart content")
-				elf.Log("ERROR", "Error parsing content of batch/multipartmixed request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			break // finished reading multpart parts
-		}
-		if err != nil {
-			elf.Log("ERROR", "Error parsing content of batch/multipartmixed request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		// check next part's content type
-		pct, _, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
-		if err != nil {
-			elf.Log("ERROR", "Error reading next parts `Content-Type` header in batch/multipartmixed request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if pct != "application/http" {
-			err = errors.New("unsupported content type for multipart/mixed content, expected each part to be application/http")
-			elf.Log("ERROR", "Error reading next parts `Content-Type` header in batch/multipartmixed request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		pr, err := http.ReadRequest(bufio.NewReader(p))
-		// we need to get the protocol from a header in the part's request
-		protocol := pr.Header.Get("Forwarded")
-		if protocol == "" || !strings.Contains(protocol, "proto=http") { // proto must be `http` or `https`
-			err = errors.New("missing header in multipart/mixed content, expected each part to contain a Forwarded header with a valid proto value (proto=http or proto=https)")
-			elf.Log("ERROR", "Missing part header in batch/multipartmixed request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		parts := strings.Split(protocol, "proto=")
-		if len(parts) < 2 || (parts[1] != "http" && parts[1] != "https") {
-			err = errors.New("invalid proto value in Forwarded header, expected proto=http or proto=https")
-			elf.Log("ERROR", "Invalid part header in batch/multipartmixed request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		protocol = parts[1]
-		url := protocol + "://" + pr.Host + pr.RequestURI
-		urls = append(urls, url)
-		// read part's body
-		// NOTE: if there is no Content-Length header the body will not have been read (will be empty)
-		pb, err := ioutil.ReadAll(pr.Body) // TODO hmmm  (http://jmoiron.net/blog/crossing-streams-a-love-letter-to-ioreader/)
-		if err != nil {
-			elf.Log("ERROR", "Error parsing content of batch/multipartmixed request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		request, err := http.NewRequest(r.Method, url, bytes.NewBuffer(pb))
-		if err != nil {
-			elf.Log("ERROR", "Error reading individual request from content in batch/multipartmixed request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		// add headers
-		request.Header = pr.Header
-		batch = append(batch, request)
+	content, ok := limitRequest(w, r, started, requestID, "batch/multipartmixed")
+	if !ok {
+		return
+	}
+	mr := multipart.NewReader(content, boundary)
+	read := 0
+	parts, err := readParts(mr, started, requestID, "", &read)
+	if le, ok := exceedsLimit(content, err); ok {
+		handleLimitError(w, started, requestID, "batch/multipartmixed", le)
+		return
+	}
+	if err != nil {
+		elf.Log("ERROR", "Error parsing content of batch/multipartmixed request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(parts) < 1 {
+		err = errors.New("invalid multipart content")
+		elf.Log("ERROR", "Error parsing content of batch/multipartmixed request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	responses, err := processors.ProcessBatch(batch, timeout)
+	// the results are returned as a HAR document if the client asks for one (as per its `Accept` header)
+	// (as this is a single document the responses are never streamed)
+	har := acceptsHAR(r)
+	if stream && !har {
+		streamParts(w, parts, timeout, processors.BatchOptions{Mode: mode, Deadline: deadline, KeepEncoding: keepEncoding}, partEncoding, started, requestID)
+		return
+	}
+
+	err = processParts(parts, timeout, processors.BatchOptions{Mode: mode, Deadline: deadline, KeepEncoding: keepEncoding}, requestID, nil)
 	if err != nil {
 		elf.Log("ERROR", "Error processing batch from batch/multipartmixed request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if har {
+		writePartsHAR(w, parts, started, requestID)
+		return
+	}
 
-	// create some variables to keep track of the indvidual responses as we process them
-	// (these are used for reporting via log output e.g. should a runtime panic occur)
-	var nextIndex int
-	var nextResponse *processors.BatchedResponse
+	// create a variable to keep track of the indvidual parts as we process them
+	// (this is used for reporting via log output e.g. should a runtime panic occur)
+	var nextPart *batchPart
 
 	// send a multipart response back
 	// (We need to buffer this in case there is an error. If we didn't and wrote
@@ -161,15 +141,15 @@ func MultipartMixed(w http.ResponseWriter, r *http.Request) {
 	mw := multipart.NewWriter(&buf)
 
 	defer func() {
-		mw.Close()
-
 		// Report state on any panic
 		if r := recover(); r != nil {
 			// TODO send this to ELF based logger via payload
 			fmt.Println("Reporting state on panic", r)
-			fmt.Println("Request", batch[nextIndex])
-			fmt.Println("Request URL", urls[nextIndex])
-			fmt.Println("Response", nextResponse)
+			if nextPart != nil {
+				fmt.Println("Request", nextPart.Request)
+				fmt.Println("Request URL", nextPart.URL)
+				fmt.Println("Response", nextPart.Response)
+			}
 
 			err = errors.New("panic while processing request")
 			elf.Log("ERROR", "Panic whilst processing batch/multipartmixed request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
@@ -182,47 +162,388 @@ func MultipartMixed(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
-
-	var pw io.Writer
+	w.Header().Set(processors.ServerTimingHeader, serverTiming(started, partResponses(flattenParts(parts))))
 
 	// the individual response are sent as `application/http` as per requests
-	for nextIndex, nextResponse = range responses {
-		ph := make(textproto.MIMEHeader)
-		ph.Set("Content-Type", "application/http")
-		pw, err = mw.CreatePart(ph)
+	for _, nextPart = range parts {
+		err = writePart(mw, nextPart, requestID, false, partEncoding)
 		if err != nil {
 			elf.Log("ERROR", "Error whilst processing batch/multipartmixed request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		if nextResponse != nil {
+	}
 
-			elf.Log("INFO", "Received "+nextResponse.Status+" from "+urls[nextIndex], elf.LogOptions{Tags: requestID, Cause: err, Started: time.Now().Add(nextResponse.ProcessingDuration * -1)})
+	// close the multipart writer to add the final boundary before writing the response
+	mw.Close()
+	// write response
+	w.Write(buf.Bytes())
+	return
+}
 
-			io.WriteString(pw, nextResponse.Proto+" "+nextResponse.Status+"\r\n")
-			if nextResponse.Header != nil {
-				nextResponse.Header.Write(pw)
-				io.WriteString(pw, "\r\n")
+// batchPart is an individual part of a batch/multipartmixed request.
+// It is either an `application/http` request or a `multipart/mixed` changeset of parts.
+type batchPart struct {
+	Sequence  int
+	ContentID string
+	URL       string
+	Request   *http.Request
+	DependsOn []string
+	Timeout   time.Duration
+	Response  *processors.BatchedResponse
+	Changeset []*batchPart
+}
+
+// readParts reads the parts of a batch/multipartmixed request (or of a changeset nested within it).
+// Parts which are invalid are given an error response so the rest of the batch can still be processed.
+// The number of parts read so far in the batch is kept in read so the batch fails once it exceeds MaxParts.
+func readParts(mr *multipart.Reader, started time.Time, requestID string, prefix string, read *int) ([]*batchPart, error) {
+	var parts []*batchPart
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return parts, nil // finished reading multpart parts
+		}
+		if err != nil {
+			return parts, err
+		}
+		*read++
+		if err = tooManyParts(*read); err != nil {
+			return parts, err
+		}
+		// the part's optional Content-ID is echoed back on its response part so clients can correlate them
+		part := &batchPart{Sequence: len(parts), ContentID: p.Header.Get("Content-ID")}
+		parts = append(parts, part)
+		var code string
+		// check part's content type
+		pct, params, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if err != nil {
+			code = "invalid_part_content_type"
+		} else if pct == "multipart/mixed" {
+			part.Changeset, err = readChangeset(p, params, started, requestID, prefix+strconv.Itoa(len(parts)-1)+".", read)
+			if _, ok := err.(*limitError); ok {
+				return parts, err
+			}
+			code = "invalid_changeset"
+		} else if pct == "application/http" {
+			part.Request, part.URL, code, err = readPart(p)
+			if err == nil {
+				// the part's request can have its own timeout specified with a `x-rrp-timeout` header
+				code = "invalid_part_timeout"
+				part.Timeout, err = partTimeout(part.Request.Header)
 			}
-			if nextResponse.Body != nil {
-				pb, err := ioutil.ReadAll(nextResponse.Body) // TODO hmmm  (http://jmoiron.net/blog/crossing-streams-a-love-letter-to-ioreader/)
-				if err != nil {
-					elf.Log("ERROR", "Error whilst reading batch/multipartmixed request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
+			if err == nil {
+				// the ids of any earlier parts this part depends on are specified in its `x-rrp-depends-on` header
+				for _, d := range part.Request.Header["X-Rrp-Depends-On"] {
+					part.DependsOn = append(part.DependsOn, strings.Split(d, ",")...)
 				}
-				pw.Write(pb)
-				io.WriteString(pw, "\r\n")
+				part.Request.Header.Del("X-Rrp-Depends-On")
 			}
 		} else {
-			err = errors.New("missing response for " + urls[nextIndex])
-			elf.Log("ERROR", "Error whilst processing batch/multipartmixed request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			err = errors.New("unsupported content type for multipart/mixed content, expected each part to be application/http or a multipart/mixed changeset")
+			code = "invalid_part_content_type"
+		}
+		if err != nil {
+			// a malformed part only fails its own request, the rest of the batch is still processed
+			elf.Log("ERROR", "Error reading individual request from content in batch/multipartmixed request", elf.LogOptions{Tags: requestID, Payload: "part=" + prefix + strconv.Itoa(len(parts)-1) + " " + processors.ErrorCodeHeader + "=" + code, Cause: err, Started: started})
+			part.Changeset = nil
+			part.Response = processors.ErrorResponse(len(parts)-1, "", partErrorStatus(code), code, err)
+		}
+	}
+}
+
+// readChangeset reads the parts of a changeset i.e. a `multipart/mixed` part nested within a batch/multipartmixed request
+func readChangeset(p *multipart.Part, params map[string]string, started time.Time, requestID string, prefix string, read *int) ([]*batchPart, error) {
+	boundary, ok := params["boundary"]
+	if !ok {
+		return nil, errors.New("missing multipart boundary for changeset")
+	}
+	changeset, err := readParts(multipart.NewReader(p, boundary), started, requestID, prefix, read)
+	if err != nil {
+		return nil, err
+	}
+	if len(changeset) < 1 {
+		return nil, errors.New("invalid changeset, expected one or more parts")
+	}
+	return changeset, nil
+}
+
+// readPart reads an individual request from an `application/http` part of a batch/multipartmixed request.
+// If the part is invalid the returned error is accompanied by a machine-readable code for the reason.
+func readPart(p *multipart.Part) (request *http.Request, url string, code string, err error) {
+	pr, err := http.ReadRequest(bufio.NewReader(p))
+	if err != nil {
+		return nil, "", "invalid_part_request", err
+	}
+	// we need to get the protocol and host from the part's request line or its Forwarded header
+	url, code, err = partURL(pr)
+	if err != nil {
+		return nil, "", code, err
+	}
+	// read part's body (up to MaxPartBodySize)
+	// NOTE: if there is no Content-Length header the body will not have been read (will be empty)
+	if err = partTooLarge(pr.ContentLength); err != nil {
+		return nil, url, "part_too_large", err
+	}
+	var prb io.Reader = pr.Body
+	if MaxPartBodySize > 0 {
+		prb = io.LimitReader(pr.Body, MaxPartBodySize+1)
+	}
+	pb, err := ioutil.ReadAll(prb) // TODO hmmm  (http://jmoiron.net/blog/crossing-streams-a-love-letter-to-ioreader/)
+	if err != nil {
+		return nil, url, "invalid_part_body", err
+	}
+	if err = partTooLarge(int64(len(pb))); err != nil {
+		return nil, url, "part_too_large", err
+	}
+	// only send a body if the part has one (e.g. a GET or HEAD request will typically not)
+	var body io.Reader
+	if len(pb) > 0 {
+		body = bytes.NewReader(pb)
+	}
+	// each part is sent using its own method (as specified in the part's request line)
+	// NOTE: but not its HTTP version, as requests are always sent using HTTP/1.1
+	request, err = http.NewRequest(pr.Method, url, body)
+	if err != nil {
+		return nil, url, "invalid_part_request", err
+	}
+	// add headers
+	request.Header = pr.Header
+	return request, url, "", nil
+}
+
+// processParts processes the requests of a batch/multipartmixed request concurrently.
+// The requests within a changeset are processed in order, with each depending on the previous
+// request in the changeset. So once a request fails the rest of the changeset is not executed
+// and each of those requests is given a 424 (Failed Dependency) response.
+// The options apply to the whole batch (the options for the individual requests are filled in from the parts).
+// If completed is not nil each part is sent on it as soon as its response
+// (or in the case of a changeset all its responses) is available.
+func processParts(parts []*batchPart, timeout time.Duration, options processors.BatchOptions, requestID string, completed chan<- *batchPart) error {
+	// flatten the parts (including any in changesets) into a single batch of requests
+	var requestParts []*batchPart
+	var topLevelParts []*batchPart // (the top level part each request belongs to)
+	var previous []int             // (the sequence of the previous request in each request's changeset or -1)
+	var inChangesets []bool        // (whether each request is in a changeset)
+	var flatten func(parts []*batchPart, topLevelPart *batchPart, inChangeset bool, last int) int
+	flatten = func(parts []*batchPart, topLevelPart *batchPart, inChangeset bool, last int) int {
+		for _, part := range parts {
+			top := topLevelPart
+			if top == nil {
+				top = part
+			}
+			if !inChangeset {
+				last = -1
+			}
+			if part.Changeset != nil {
+				last = flatten(part.Changeset, top, true, last)
+				continue
+			}
+			requestParts = append(requestParts, part)
+			topLevelParts = append(topLevelParts, top)
+			previous = append(previous, last)
+			inChangesets = append(inChangesets, inChangeset)
+			last = len(requestParts) - 1
+		}
+		return last
+	}
+	flatten(parts, nil, false, -1)
+
+	z := len(requestParts)
+	requests := make([]*http.Request, z)
+	responses := make([]*processors.BatchedResponse, z)
+	ids := make([]string, z)
+	for i, part := range requestParts {
+		requests[i] = part.Request
+		responses[i] = part.Response
+		ids[i] = trimContentID(part.ContentID)
+	}
+	options.Parts = make([]processors.PartOptions, z)
+	pending := make(map[*batchPart]int)
+	for i, part := range requestParts {
+		pending[topLevelParts[i]]++
+		options.Parts[i].ID = ids[i]
+		// the requests in a changeset are always sent (even the first, which does not depend on any other request)
+		// rather than being deduplicated with identical requests outside the changeset
+		options.Parts[i].AlwaysSend = inChangesets[i]
+		if responses[i] != nil {
+			continue
+		}
+		dependsOn, err := dependencies(i, part.DependsOn, ids)
+		if err != nil {
+			responses[i] = processors.ErrorResponse(i, part.Request.Proto, http.StatusBadRequest, "invalid_dependency", err)
+			continue
+		}
+		if previous[i] >= 0 {
+			dependsOn = append(dependsOn, previous[i])
+		}
+		options.Parts[i].DependsOn = dependsOn
+		options.Parts[i].Timeout = part.Timeout
+	}
+
+	return processBatch(requests, responses, timeout, options, requestID, func(i int) {
+		requestParts[i].Response = responses[i]
+		top := topLevelParts[i]
+		pending[top]--
+		if pending[top] == 0 && completed != nil {
+			completed <- top
+		}
+	})
+}
+
+// streamParts processes the parts of a batch/multipartmixed request writing each response part to
+// the response stream (using chunked transfer encoding) as soon as it is available.
+// As the response parts are written in the order they complete, rather than the same sequence as
+// their corresponding requests, each is tagged with an `x-rrp-sequence` header (along with the
+// Content-ID of its request if one was specified).
+func streamParts(w http.ResponseWriter, parts []*batchPart, timeout time.Duration, options processors.BatchOptions, partEncoding string, started time.Time, requestID string) {
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	w.Header().Set("x-rrp-stream", "true")
+	// the summary of the timings is only available once all the parts have been written so is sent as a trailer
+	w.Header().Set("Trailer", processors.ServerTimingHeader)
+	w.WriteHeader(http.StatusOK)
+	flush := func() {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	flush()
+
+	completed := make(chan *batchPart, len(parts))
+	errs := make(chan error, 1)
+	go func() {
+		errs <- processParts(parts, timeout, options, requestID, completed)
+		close(completed)
+	}()
+	written := make(map[*batchPart]bool)
+	for part := range completed {
+		if err := writePart(mw, part, requestID, true, partEncoding); err != nil {
+			// (the status has already been sent so all we can do is log the error)
+			elf.Log("ERROR", "Error whilst streaming batch/multipartmixed request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
 			return
 		}
+		written[part] = true
+		flush()
 	}
+	if err := <-errs; err != nil {
+		elf.Log("ERROR", "Error processing batch from batch/multipartmixed request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
+		// the status has already been sent so any parts still without a response are returned as errors
+		for _, part := range parts {
+			if !written[part] {
+				part.Changeset = nil
+				part.Response = processors.ErrorResponse(part.Sequence, "", http.StatusInternalServerError, "missing_response", err)
+				writePart(mw, part, requestID, true, partEncoding)
+			}
+		}
+	}
+	mw.Close()
+	w.Header().Set(processors.ServerTimingHeader, serverTiming(started, partResponses(flattenParts(parts))))
+	flush()
+	elf.Log("INFO", "Completed handling of batch/multipartmixed request", elf.LogOptions{Tags: requestID, Started: started})
+}
 
-	// write response
-	w.Write(buf.Bytes())
-	return
+// writePartsHAR writes the responses for the parts of a batch/multipartmixed request as a HAR document
+// with an entry for each request (including those in changesets) in the same sequence as the requests
+func writePartsHAR(w http.ResponseWriter, parts []*batchPart, started time.Time, requestID string) {
+	requestParts := flattenParts(parts)
+	requests := make([]*http.Request, len(requestParts))
+	urls := make([]string, len(requestParts))
+	ids := make([]string, len(requestParts))
+	for i, part := range requestParts {
+		requests[i], urls[i], ids[i] = part.Request, part.URL, trimContentID(part.ContentID)
+	}
+	writeBatchHAR(w, requests, urls, ids, partResponses(requestParts), started, requestID, "batch/multipartmixed")
+}
+
+// flattenParts returns the parts of a batch/multipartmixed request which are requests (including those in changesets) in sequence
+func flattenParts(parts []*batchPart) []*batchPart {
+	var requestParts []*batchPart
+	for _, part := range parts {
+		if part.Changeset != nil {
+			requestParts = append(requestParts, flattenParts(part.Changeset)...)
+			continue
+		}
+		requestParts = append(requestParts, part)
+	}
+	return requestParts
+}
+
+// partResponses returns the responses of the parts of a batch/multipartmixed request
+func partResponses(parts []*batchPart) []*processors.BatchedResponse {
+	responses := make([]*processors.BatchedResponse, len(parts))
+	for i, part := range parts {
+		responses[i] = part.Response
+	}
+	return responses
+}
+
+// writePart writes the response for a part of a batch/multipartmixed request.
+// The response for a changeset is written as a nested `multipart/mixed` part mirroring the request.
+// If tagSequence is true the response part includes an `x-rrp-sequence` header with the sequence of its request.
+// If an encoding (gzip or deflate) is specified the content of each `application/http` part is compressed
+// accordingly and the part includes a `Content-Encoding` header.
+func writePart(mw *multipart.Writer, part *batchPart, requestID string, tagSequence bool, encoding string) error {
+	ph := make(textproto.MIMEHeader)
+	if part.ContentID != "" {
+		ph.Set("Content-ID", responseContentID(part.ContentID))
+	}
+	if tagSequence {
+		ph.Set("x-rrp-sequence", strconv.Itoa(part.Sequence))
+	}
+	if part.Changeset != nil {
+		var buf bytes.Buffer
+		cw := multipart.NewWriter(&buf)
+		for _, p := range part.Changeset {
+			if err := writePart(cw, p, requestID, tagSequence, encoding); err != nil {
+				return err
+			}
+		}
+		cw.Close()
+		ph.Set("Content-Type", "multipart/mixed; boundary="+cw.Boundary())
+		pw, err := mw.CreatePart(ph)
+		if err != nil {
+			return err
+		}
+		_, err = pw.Write(buf.Bytes())
+		return err
+	}
+	ph.Set("Content-Type", "application/http")
+	if encoding != "" {
+		ph.Set("Content-Encoding", encoding)
+	}
+	mp, err := mw.CreatePart(ph)
+	if err != nil {
+		return err
+	}
+	var pw io.Writer = mp
+	if encoding != "" {
+		c := newCompressor(pw, encoding)
+		defer c.Close()
+		pw = c
+	}
+	response := part.Response
+	if response == nil {
+		return errors.New("missing response for " + part.URL)
+	}
+
+	logResponse(requestID, part.URL, response)
+
+	io.WriteString(pw, response.Proto+" "+response.Status+"\r\n")
+	if response.Header != nil {
+		response.Header.Write(pw)
+	}
+	io.WriteString(pw, "\r\n")
+	// NOTE: there is no body for responses to HEAD requests (even if they include a Content-Length header)
+	if response.Body != nil {
+		pb, err := ioutil.ReadAll(response.Body) // TODO hmmm  (http://jmoiron.net/blog/crossing-streams-a-love-letter-to-ioreader/)
+		if err != nil {
+			return err
+		}
+		// (the body is written as is so it matches the response's Content-Length header, followed by a CRLF
+		// before the boundary as RRP has always done so that the framing of the batch response is unchanged)
+		pw.Write(pb)
+		io.WriteString(pw, "\r\n")
+	}
+	return nil
 }
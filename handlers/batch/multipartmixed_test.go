@@ -0,0 +1,304 @@
+package batch
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// postMultipartMixed sends the specified `application/http` parts to the MultipartMixed handler
+// (a part can be prefixed with MIME headers for the part e.g. "Content-ID: <item1>\r\n\r\nGET / HTTP/1.1...")
+func postMultipartMixed(t *testing.T, header http.Header, parts ...string) *httptest.ResponseRecorder {
+	content, boundary := writeMultipartMixed(t, parts...)
+	req := httptest.NewRequest("POST", "/batch/multipartmixed", bytes.NewReader(content))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+boundary)
+	rec := httptest.NewRecorder()
+	MultipartMixed(rec, req)
+	return rec
+}
+
+// changeset returns a part containing the specified parts as a nested `multipart/mixed` changeset
+func changeset(t *testing.T, parts ...string) string {
+	content, boundary := writeMultipartMixed(t, parts...)
+	return "Content-Type: multipart/mixed; boundary=" + boundary + "\r\n\r\n" + string(content)
+}
+
+func writeMultipartMixed(t *testing.T, parts ...string) ([]byte, string) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, part := range parts {
+		ph := make(textproto.MIMEHeader)
+		ph.Set("Content-Type", "application/http")
+		if strings.HasPrefix(part, "Content-") {
+			h, err := textproto.NewReader(bufio.NewReader(strings.NewReader(part))).ReadMIMEHeader()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range h {
+				ph[k] = v
+			}
+			part = part[strings.Index(part, "\r\n\r\n")+4:]
+		}
+		pw, err := mw.CreatePart(ph)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pw.Write([]byte(part))
+	}
+	mw.Close()
+	return buf.Bytes(), mw.Boundary()
+}
+
+// readMultipartMixed reads the `application/http` responses returned by the MultipartMixed handler
+// (the Content-ID and x-rrp-sequence of each response part are added to the response's header for convenience
+// and the responses of any changesets are flattened in sequence)
+func readMultipartMixed(t *testing.T, rec *httptest.ResponseRecorder) []*http.Response {
+	return readResponseParts(t, rec.Body, rec.Header().Get("Content-Type"))
+}
+
+func readResponseParts(t *testing.T, r io.Reader, contentType string) []*http.Response {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatalf("invalid response content type %q", contentType)
+	}
+	var responses []*http.Response
+	mr := multipart.NewReader(r, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		if strings.HasPrefix(p.Header.Get("Content-Type"), "multipart/mixed") {
+			responses = append(responses, readResponseParts(t, p, p.Header.Get("Content-Type"))...)
+			continue
+		}
+		pb, _ := ioutil.ReadAll(p)
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(pb)), nil)
+		if err != nil {
+			t.Fatalf("invalid response part %q: %s", pb, err)
+		}
+		for _, h := range []string{"Content-ID", "x-rrp-sequence"} {
+			if v := p.Header.Get(h); v != "" {
+				res.Header.Set(h, v)
+			}
+		}
+		responses = append(responses, res)
+	}
+	return responses
+}
+
+func TestMultipartMixed(t *testing.T) {
+	var calls int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("x-method", r.Method)
+		w.Header().Set("x-query", r.URL.RawQuery)
+		w.Header().Set("x-proto", r.Proto)
+		w.Header().Set("x-call", strconv.FormatInt(atomic.AddInt64(&calls, 1), 10))
+		w.Write([]byte(r.Method + ":" + string(body)))
+	}))
+	defer upstream.Close()
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	t.Log("We should be able to make requests to batch/multipartmixed")
+	{
+		t.Log("\tWhen sending parts with different methods")
+		{
+			rec := postMultipartMixed(t, nil,
+				"Content-ID: <item1>\r\n\r\nGET /route1?name=Bob HTTP/1.1\r\nHost: "+host+"\r\nForwarded: proto=http\r\n\r\n",
+				"PUT /route2 HTTP/1.1\r\nHost: "+host+"\r\nForwarded: proto=http\r\nContent-Length: 5\r\n\r\nAlice",
+				"HEAD /route3 HTTP/1.1\r\nHost: "+host+"\r\nForwarded: proto=http\r\n\r\n",
+			)
+			raw := rec.Body.String()
+			responses := readMultipartMixed(t, rec)
+			if len(responses) != 3 {
+				t.Fatalf("\t\tShould receive 3 responses, but received %d %v", len(responses), cross)
+			}
+			for i, method := range []string{"GET", "PUT", "HEAD"} {
+				if responses[i].Header.Get("x-method") == method {
+					t.Logf("\t\tShould send part %d as %s %v", i, method, tick)
+				} else {
+					t.Errorf("\t\tShould send part %d as %s, but sent %s %v", i, method, responses[i].Header.Get("x-method"), cross)
+				}
+			}
+			if responses[0].Header.Get("x-query") == "name=Bob" {
+				t.Log("\t\tShould preserve the part's query string", tick)
+			} else {
+				t.Errorf("\t\tShould preserve the part's query string, but received %q %v", responses[0].Header.Get("x-query"), cross)
+			}
+			if responses[0].Header.Get("Content-ID") == "<response-item1>" && responses[1].Header.Get("Content-ID") == "" {
+				t.Log("\t\tShould echo the part's Content-ID on its response part", tick)
+			} else {
+				t.Errorf("\t\tShould echo the part's Content-ID on its response part, but received %q %v", responses[0].Header.Get("Content-ID"), cross)
+			}
+			body, _ := ioutil.ReadAll(responses[1].Body)
+			if string(body) == "PUT:Alice" {
+				t.Log("\t\tShould send the part's body", tick)
+			} else {
+				t.Errorf("\t\tShould send the part's body, but received %q %v", body, cross)
+			}
+			if strings.Contains(raw, "PUT:Alice\r\n\r\n--") {
+				t.Log("\t\tShould follow the body of a response part with a CRLF before the boundary", tick)
+			} else {
+				t.Errorf("\t\tShould follow the body of a response part with a CRLF before the boundary, but received %q %v", raw, cross)
+			}
+		}
+
+		t.Log("\tWhen sending a part with an HTTP/1.0 request line")
+		{
+			rec := postMultipartMixed(t, nil,
+				"GET /route1 HTTP/1.0\r\nHost: "+host+"\r\nForwarded: proto=http\r\n\r\n",
+			)
+			responses := readMultipartMixed(t, rec)
+			if len(responses) == 1 && responses[0].Header.Get("x-proto") == "HTTP/1.1" {
+				t.Log("\t\tShould send the part's request using HTTP/1.1", tick)
+			} else {
+				t.Errorf("\t\tShould send the part's request using HTTP/1.1, but received %d responses %v", len(responses), cross)
+			}
+		}
+
+		t.Log("\tWhen sending a part with a host in its Forwarded header")
+		{
+			rec := postMultipartMixed(t, nil,
+				"GET /route1 HTTP/1.1\r\nHost: unknown.invalid\r\nForwarded: for=1.2.3.4;proto=http;host=\""+host+"\"\r\n\r\n",
+			)
+			responses := readMultipartMixed(t, rec)
+			if len(responses) == 1 && responses[0].StatusCode == http.StatusOK && responses[0].Header.Get("x-method") == "GET" {
+				t.Log("\t\tShould send the part's request to the forwarded host", tick)
+			} else {
+				t.Errorf("\t\tShould send the part's request to the forwarded host, but received %d responses %v", len(responses), cross)
+			}
+		}
+
+		t.Log("\tWhen sending a part with an absolute-form request line")
+		{
+			rec := postMultipartMixed(t, nil,
+				"GET "+upstream.URL+"/route1?name=Bob HTTP/1.1\r\n\r\n",
+			)
+			responses := readMultipartMixed(t, rec)
+			if len(responses) == 1 && responses[0].StatusCode == http.StatusOK && responses[0].Header.Get("x-query") == "name=Bob" {
+				t.Log("\t\tShould send the part's request to its absolute URL", tick)
+			} else {
+				t.Errorf("\t\tShould send the part's request to its absolute URL, but received %d responses %v", len(responses), cross)
+			}
+		}
+
+		t.Log("\tWhen sending malformed parts")
+		{
+			rec := postMultipartMixed(t, nil,
+				"NOT A REQUEST LINE\r\n\r\n",
+				"GET /route1 HTTP/1.1\r\nHost: "+host+"\r\n\r\n",
+				"GET /route2 HTTP/1.1\r\nHost: "+host+"\r\nForwarded: proto=http\r\n\r\n",
+			)
+			responses := readMultipartMixed(t, rec)
+			if rec.Code != http.StatusOK || len(responses) != 3 {
+				t.Fatalf("\t\tShould still process the batch, but received %d with %d responses %v", rec.Code, len(responses), cross)
+			}
+			t.Log("\t\tShould still process the batch", tick)
+			for i, code := range []string{"invalid_part_request", "missing_forwarded_header"} {
+				if responses[i].StatusCode == http.StatusBadRequest && responses[i].Header.Get("x-rrp-error-code") == code {
+					t.Logf("\t\tShould receive an error response with code %s for part %d %v", code, i, tick)
+				} else {
+					t.Errorf("\t\tShould receive an error response with code %s for part %d, but received %s %q %v", code, i, responses[i].Status, responses[i].Header.Get("x-rrp-error-code"), cross)
+				}
+			}
+			if responses[2].StatusCode == http.StatusOK && responses[2].Header.Get("x-method") == "GET" {
+				t.Log("\t\tShould receive a response for the valid part", tick)
+			} else {
+				t.Errorf("\t\tShould receive a response for the valid part, but received %s %v", responses[2].Status, cross)
+			}
+		}
+
+		t.Log("\tWhen sending changesets")
+		{
+			rec := postMultipartMixed(t, nil,
+				changeset(t,
+					"POST /route1 HTTP/1.1\r\nHost: "+host+"\r\nForwarded: proto=http\r\n\r\n",
+					"PATCH /route2 HTTP/1.1\r\nHost: "+host+"\r\nForwarded: proto=http\r\n\r\n",
+				),
+				changeset(t,
+					"POST /route3 HTTP/1.1\r\nHost: "+host+"\r\n\r\n",
+					"PATCH /route4 HTTP/1.1\r\nHost: "+host+"\r\nForwarded: proto=http\r\n\r\n",
+				),
+				"GET /route5 HTTP/1.1\r\nHost: "+host+"\r\nForwarded: proto=http\r\n\r\n",
+			)
+			if !strings.Contains(rec.Body.String(), "Content-Type: multipart/mixed; boundary=") {
+				t.Errorf("\t\tShould receive nested multipart/mixed parts for the changesets %v", cross)
+			}
+			responses := readMultipartMixed(t, rec)
+			if len(responses) != 5 {
+				t.Fatalf("\t\tShould receive 5 responses, but received %d %v", len(responses), cross)
+			}
+			if responses[0].Header.Get("x-method") == "POST" && responses[1].Header.Get("x-method") == "PATCH" {
+				t.Log("\t\tShould process a successful changeset", tick)
+			} else {
+				t.Errorf("\t\tShould process a successful changeset, but received %s and %s %v", responses[0].Status, responses[1].Status, cross)
+			}
+			if responses[2].StatusCode == http.StatusBadRequest && responses[3].StatusCode == http.StatusFailedDependency {
+				t.Log("\t\tShould skip the rest of a changeset once a request fails", tick)
+			} else {
+				t.Errorf("\t\tShould skip the rest of a changeset once a request fails, but received %s and %s %v", responses[2].Status, responses[3].Status, cross)
+			}
+			if responses[4].Header.Get("x-method") == "GET" {
+				t.Log("\t\tShould process requests outside of the changesets", tick)
+			} else {
+				t.Errorf("\t\tShould process requests outside of the changesets, but received %s %v", responses[4].Status, cross)
+			}
+		}
+
+		t.Log("\tWhen sending a changeset with a request identical to one outside of it")
+		{
+			rec := postMultipartMixed(t, nil,
+				changeset(t,
+					"GET /route1 HTTP/1.1\r\nHost: "+host+"\r\nForwarded: proto=http\r\n\r\n",
+					"PATCH /route2 HTTP/1.1\r\nHost: "+host+"\r\nForwarded: proto=http\r\n\r\n",
+				),
+				"GET /route1 HTTP/1.1\r\nHost: "+host+"\r\nForwarded: proto=http\r\n\r\n",
+			)
+			responses := readMultipartMixed(t, rec)
+			if len(responses) != 3 {
+				t.Fatalf("\t\tShould receive 3 responses, but received %d %v", len(responses), cross)
+			}
+			if responses[0].Header.Get("x-call") != responses[2].Header.Get("x-call") {
+				t.Log("\t\tShould send the request in the changeset and the request outside of it", tick)
+			} else {
+				t.Errorf("\t\tShould send the request in the changeset and the request outside of it, but received call %s for both %v", responses[0].Header.Get("x-call"), cross)
+			}
+		}
+
+		t.Log("\tWhen sending a `x-rrp-stream` header of `true`")
+		{
+			rec := postMultipartMixed(t, http.Header{"X-Rrp-Stream": {"true"}},
+				"Content-ID: <slow>\r\n\r\nGET /slow HTTP/1.1\r\nHost: "+host+"\r\nForwarded: proto=http\r\n\r\n",
+				"Content-ID: <fast>\r\n\r\nGET /fast HTTP/1.1\r\nHost: "+host+"\r\nForwarded: proto=http\r\n\r\n",
+			)
+			responses := readMultipartMixed(t, rec)
+			if len(responses) != 2 {
+				t.Fatalf("\t\tShould receive 2 responses, but received %d %v", len(responses), cross)
+			}
+			if responses[0].Header.Get("Content-ID") == "<response-fast>" && responses[0].Header.Get("x-rrp-sequence") == "1" &&
+				responses[1].Header.Get("Content-ID") == "<response-slow>" && responses[1].Header.Get("x-rrp-sequence") == "0" {
+				t.Log("\t\tShould receive each response as soon as it completes tagged with its sequence", tick)
+			} else {
+				t.Errorf("\t\tShould receive each response as soon as it completes tagged with its sequence, but received %v and %v %v", responses[0].Header, responses[1].Header, cross)
+			}
+		}
+	}
+}
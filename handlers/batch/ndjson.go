@@ -0,0 +1,321 @@
+package batch
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/8legd/RRP/logging/elf"
+	"github.com/8legd/RRP/processors"
+)
+
+// MaxStreamConcurrency is the maximum number of requests of a batch/ndjson request processed at once (when they are
+// processed in parallel). Once reached the next line is only read when a request completes.
+var MaxStreamConcurrency = 64
+
+// ndjsonResponse is an individual response in a batch/ndjson response.
+// As responses are written in the order they complete each is tagged with the (zero based) sequence of its request.
+type ndjsonResponse struct {
+	Sequence int `json:"sequence"`
+	jsonResponse
+}
+
+// ndjsonStream holds the state of a batch/ndjson request whilst its requests are being processed
+type ndjsonStream struct {
+	w         http.ResponseWriter
+	started   time.Time
+	requestID string
+	timeout   time.Duration
+	mode      processors.Mode
+	options   processors.BatchOptions
+	// mu guards writing responses (and failed) as they complete
+	mu      sync.Mutex
+	encoder *json.Encoder
+	failed  bool
+	wg      sync.WaitGroup
+	// slots limits the number of requests processed at once (see MaxStreamConcurrency)
+	slots chan struct{}
+	// slowest summarises the timings of the responses written so far and completed counts them
+	// (the responses themselves are not kept as the stream can be long lived)
+	slowest   processors.Timings
+	completed int
+	// if the results are returned as a HAR document they are collected (by sequence) rather than written as they complete
+	// with the size of the bodies they hold limited by processors.MaxResponseSize (as the stream can be long lived)
+	har      bool
+	entries  map[int]harEntry
+	buffered int64
+	tooLarge *limitError
+}
+
+// NDJSON handles a stream of HTTP requests in newline delimited JSON format i.e. one request object per line
+// as per the batch/json format e.g. `{"method": "GET", "url": "https://www.example.com/", "headers": {}, "body": ""}`
+// Each request is processed as soon as its line has been read and its response is written as a line as
+// soon as it completes e.g. `{"sequence": 0, "status": "200 OK", "statusCode": 200, "headers": {}, "body": "", "durationMs": 12.3}`
+// so a client can send any number of requests through a single long lived connection.
+func NDJSON(w http.ResponseWriter, r *http.Request) {
+	started := time.Now()
+	requestID := "REQUEST_ID:" + r.Header.Get("x-request-id")
+	elf.Log("INFO", "Started handling of batch/ndjson request", elf.LogOptions{Tags: requestID, Started: started})
+	// the response is compressed if the client accepts it (as per its `Accept-Encoding` header)
+	w, closeResponse := compressResponse(w, r)
+	defer closeResponse()
+	ct, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		handleError(w, started, requestID, http.StatusBadRequest, "Error parsing `Content-Type` header of batch/ndjson request", err)
+		return
+	}
+	if ct != "application/x-ndjson" && ct != "application/jsonl" {
+		err = errors.New("unsupported content type, expected application/x-ndjson")
+		handleError(w, started, requestID, http.StatusBadRequest, "Error parsing `Content-Type` header of batch/ndjson request", err)
+		return
+	}
+	// check for optional timeout header
+	timeout, ok := parseTimeout(w, r, started, requestID, "batch/ndjson")
+	if !ok {
+		return
+	}
+	// check for optional mode header
+	mode, ok := parseMode(w, r, started, requestID, "batch/ndjson")
+	if !ok {
+		return
+	}
+	// check for optional deadline header
+	deadline, ok := parseDeadline(w, r, started, requestID, "batch/ndjson")
+	if !ok {
+		return
+	}
+	// check for optional header to pass compressed upstream responses through verbatim
+	keepEncoding, ok := parseFlag(w, r, started, requestID, "batch/ndjson", "x-rrp-keep-encoding")
+	if !ok {
+		return
+	}
+
+	// Read request body - should be one request per line - processing each request as it is read
+	defer func() {
+		r.Body.Close()
+	}()
+	content, ok := limitRequest(w, r, started, requestID, "batch/ndjson")
+	if !ok {
+		return
+	}
+
+	// the responses are written whilst the request is still being read
+	// (the error is ignored as not all http.ResponseWriters support this e.g. for HTTP/2 it is not needed)
+	http.NewResponseController(w).EnableFullDuplex()
+	s := &ndjsonStream{
+		w:         w,
+		started:   started,
+		requestID: requestID,
+		timeout:   timeout,
+		mode:      mode,
+		options:   processors.BatchOptions{Deadline: deadline, KeepEncoding: keepEncoding},
+		encoder:   json.NewEncoder(w),
+		slots:     make(chan struct{}, MaxStreamConcurrency),
+		// the results are returned as a HAR document if the client asks for one (as per its `Accept` header)
+		har:     acceptsHAR(r),
+		entries: make(map[int]harEntry),
+	}
+	if !s.har {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		// the summary of the timings is only available once all the responses have been written so is sent as a trailer
+		w.Header().Set("Trailer", processors.ServerTimingHeader)
+		w.WriteHeader(http.StatusOK)
+		s.flush()
+	}
+
+	br := bufio.NewReader(content)
+	sequence := 0
+	for {
+		// (no more requests are read once the HAR document is too large to return)
+		if s.harTooLarge() {
+			break
+		}
+		line, err := br.ReadBytes('\n')
+		if (err == nil || err == io.EOF) && len(bytes.TrimSpace(line)) > 0 {
+			if limitErr := tooManyParts(sequence + 1); limitErr != nil {
+				s.write(sequence, "", nil, "", processors.ErrorResponse(sequence, "", http.StatusRequestEntityTooLarge, "too_many_requests", limitErr))
+				elf.Log("ERROR", "Limit exceeded by batch/ndjson request", elf.LogOptions{Tags: requestID, Cause: limitErr, Started: started})
+				break
+			}
+			if s.mode == processors.ModeParallel {
+				s.slots <- struct{}{}
+				s.wg.Add(1)
+				go func(sequence int, line []byte) {
+					defer func() {
+						<-s.slots
+						s.wg.Done()
+					}()
+					s.process(sequence, line)
+				}(sequence, line)
+			} else {
+				// when processing sequentially each request is processed before the next line is read
+				s.process(sequence, line)
+			}
+			sequence++
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// (the status has already been sent so the error is returned in place of the next response)
+			code, statusCode := "invalid_request", http.StatusBadRequest
+			if le, ok := exceedsLimit(content, err); ok {
+				code, statusCode, err = "request_too_large", http.StatusRequestEntityTooLarge, le
+			}
+			elf.Log("ERROR", "Error reading content of batch/ndjson request", elf.LogOptions{Tags: requestID, Cause: err, Started: started})
+			s.write(sequence, "", nil, "", processors.ErrorResponse(sequence, "", statusCode, code, err))
+			break
+		}
+	}
+	s.wg.Wait()
+	if s.tooLarge != nil {
+		handleLimitError(w, started, requestID, "batch/ndjson", s.tooLarge)
+		return
+	}
+	if s.har {
+		entries := make([]harEntry, 0, len(s.entries))
+		for i := 0; i < len(s.entries); i++ {
+			entries = append(entries, s.entries[i])
+		}
+		w.Header().Set(processors.ServerTimingHeader, s.slowest.ServerTiming(time.Since(started)))
+		writeHAR(w, entries, started, requestID, "batch/ndjson")
+		return
+	}
+	w.Header().Set(processors.ServerTimingHeader, s.slowest.ServerTiming(time.Since(started)))
+	elf.Log("INFO", "Completed handling of batch/ndjson request", elf.LogOptions{Tags: requestID, Payload: "responses=" + strconv.Itoa(s.completed), Started: started})
+}
+
+// process processes an individual request of a batch/ndjson request and writes its response
+func (s *ndjsonStream) process(sequence int, line []byte) {
+	var jr jsonRequest
+	var request *http.Request
+	var response *processors.BatchedResponse
+	var timeout time.Duration
+	code := "invalid_request"
+	err := json.Unmarshal(line, &jr)
+	if err == nil {
+		request, err = jr.newRequest()
+	}
+	if err == nil {
+		code = "part_too_large"
+		err = partTooLarge(request.ContentLength)
+	}
+	if err == nil {
+		// the request can have its own timeout specified with a `x-rrp-timeout` header
+		code = "invalid_timeout"
+		timeout, err = partTimeout(request.Header)
+	}
+	if err == nil && len(jr.DependsOn) > 0 {
+		code = "invalid_dependency"
+		err = errors.New("dependencies between requests are not supported by batch/ndjson")
+	}
+	if err != nil {
+		elf.Log("ERROR", "Error reading individual request from content in batch/ndjson request", elf.LogOptions{Tags: s.requestID, Payload: "index=" + strconv.Itoa(sequence) + " " + processors.ErrorCodeHeader + "=" + code, Cause: err, Started: s.started})
+		response = processors.ErrorResponse(sequence, "", partErrorStatus(code), code, err)
+	}
+
+	if response == nil && s.mode == processors.ModeSequentialStopOnError && s.hasFailed() {
+		err = errors.New("request not executed as an earlier request in the batch failed")
+		response = processors.ErrorResponse(sequence, request.Proto, http.StatusFailedDependency, "not_executed", err)
+	}
+	if response == nil {
+		options := s.options
+		options.Parts = []processors.PartOptions{{Timeout: timeout}}
+		responses, err := processors.ProcessBatch([]*http.Request{request}, s.timeout, options)
+		if err != nil {
+			response = processors.ErrorResponse(sequence, request.Proto, http.StatusInternalServerError, "missing_response", err)
+		} else {
+			response = responses[0]
+		}
+		logResponse(s.requestID, jr.URL, response)
+	}
+	s.write(sequence, jr.ID, request, jr.URL, response)
+}
+
+func (s *ndjsonStream) hasFailed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failed
+}
+
+// write writes the response for an individual request of a batch/ndjson request as a line
+// (or if the results are returned as a HAR document adds an entry for the request and its response)
+func (s *ndjsonStream) write(sequence int, id string, request *http.Request, url string, response *processors.BatchedResponse) {
+	if s.har {
+		s.addEntry(sequence, id, request, url, response)
+		return
+	}
+	jr, err := newJSONResponse(response)
+	if err != nil {
+		elf.Log("ERROR", "Error whilst reading batch/ndjson request", elf.LogOptions{Tags: s.requestID, Cause: err, Started: s.started})
+		jr, _ = newJSONResponse(processors.ErrorResponse(sequence, "", http.StatusInternalServerError, "missing_response", err))
+	}
+	// the request's optional id is echoed back on its response so clients can correlate them
+	jr.ID = id
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if response.StatusCode < 200 || response.StatusCode >= 400 {
+		s.failed = true
+	}
+	s.slowest = s.slowest.Slowest(response.Timings)
+	s.completed++
+	if err := s.encoder.Encode(ndjsonResponse{sequence, *jr}); err != nil {
+		// (the status has already been sent so all we can do is log the error)
+		elf.Log("ERROR", "Error whilst streaming batch/ndjson request", elf.LogOptions{Tags: s.requestID, Cause: err, Started: s.started})
+		return
+	}
+	s.flush()
+}
+
+// addEntry adds the HAR entry for an individual request of a batch/ndjson request and its response
+func (s *ndjsonStream) addEntry(sequence int, id string, request *http.Request, url string, response *processors.BatchedResponse) {
+	entry, err := newHAREntry(request, url, id, response, s.started)
+	if err != nil {
+		elf.Log("ERROR", "Error whilst reading batch/ndjson request", elf.LogOptions{Tags: s.requestID, Cause: err, Started: s.started})
+		entry, _ = newHAREntry(request, url, id, processors.ErrorResponse(sequence, "", http.StatusInternalServerError, "missing_response", err), s.started)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if response.StatusCode < 200 || response.StatusCode >= 400 {
+		s.failed = true
+	}
+	s.slowest = s.slowest.Slowest(response.Timings)
+	s.completed++
+	if s.tooLarge != nil {
+		return
+	}
+	if request != nil && request.ContentLength > 0 {
+		s.buffered += request.ContentLength
+	}
+	if response.Body != nil {
+		s.buffered += response.Body.Size()
+	}
+	if processors.MaxResponseSize > 0 && s.buffered > processors.MaxResponseSize {
+		// (the entries are dropped straight away as only the error is returned)
+		s.tooLarge = &limitError{fmt.Errorf("HAR document for batch/ndjson request exceeds the maximum size of %d bytes", processors.MaxResponseSize)}
+		s.entries = nil
+		return
+	}
+	s.entries[sequence] = entry
+}
+
+// harTooLarge checks whether the HAR document being collected has exceeded processors.MaxResponseSize
+func (s *ndjsonStream) harTooLarge() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tooLarge != nil
+}
+
+func (s *ndjsonStream) flush() {
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,155 @@
+package batch
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNDJSON(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte(r.Method + " " + r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	readResponses := func(t *testing.T, r io.Reader) []ndjsonResponse {
+		var responses []ndjsonResponse
+		decoder := json.NewDecoder(r)
+		for {
+			var response ndjsonResponse
+			if err := decoder.Decode(&response); err != nil {
+				break
+			}
+			responses = append(responses, response)
+		}
+		return responses
+	}
+
+	t.Log("We should be able to make requests to batch/ndjson")
+	{
+		content := `{"id": "slow", "url": "` + upstream.URL + `/slow"}` + "\n" +
+			"\n" +
+			`{"id": "fast", "method": "POST", "url": "` + upstream.URL + `/fast"}` + "\n" +
+			`NOT JSON` + "\n" +
+			`{"url": "` + upstream.URL + `/dependent", "dependsOn": ["slow"]}`
+		req := httptest.NewRequest("POST", "/batch/ndjson", strings.NewReader(content))
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		rec := httptest.NewRecorder()
+		NDJSON(rec, req)
+
+		responses := readResponses(t, rec.Body)
+		if rec.Header().Get("Content-Type") != "application/x-ndjson" || len(responses) != 4 {
+			t.Fatalf("\t\tShould receive 4 lines of responses, but received `%s` %v", rec.Body.String(), cross)
+		}
+		t.Log("\t\tShould receive 4 lines of responses", tick)
+		if responses[len(responses)-1].Sequence == 0 && responses[len(responses)-1].ID == "slow" && responses[len(responses)-1].Body == "GET /slow" {
+			t.Log("\t\tShould receive each response as soon as it completes tagged with its sequence", tick)
+		} else {
+			t.Errorf("\t\tShould receive each response as soon as it completes tagged with its sequence, but received %+v %v", responses[len(responses)-1], cross)
+		}
+		received := map[int]ndjsonResponse{}
+		for _, response := range responses {
+			received[response.Sequence] = response
+		}
+		if received[1].ID == "fast" && received[1].Body == "POST /fast" {
+			t.Log("\t\tShould ignore blank lines", tick)
+		} else {
+			t.Errorf("\t\tShould ignore blank lines, but received %+v %v", received[1], cross)
+		}
+		if received[2].StatusCode == http.StatusBadRequest && received[2].Headers.Get("x-rrp-error-code") == "invalid_request" &&
+			received[3].StatusCode == http.StatusBadRequest && received[3].Headers.Get("x-rrp-error-code") == "invalid_dependency" {
+			t.Log("\t\tShould receive error responses for invalid lines", tick)
+		} else {
+			t.Errorf("\t\tShould receive error responses for invalid lines, but received %+v and %+v %v", received[2], received[3], cross)
+		}
+	}
+
+	t.Log("We should be able to stream requests to batch/ndjson")
+	{
+		server := httptest.NewServer(http.HandlerFunc(NDJSON))
+		defer server.Close()
+		pr, pw := io.Pipe()
+		req, _ := http.NewRequest("POST", server.URL, pr)
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		go io.WriteString(pw, `{"url": "`+upstream.URL+`/first"}`+"\n")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("\t\tShould receive a response, but received %s %v", err, cross)
+		}
+		defer res.Body.Close()
+		lines := bufio.NewReader(res.Body)
+		first, err := lines.ReadString('\n')
+		if err == nil && strings.Contains(first, "GET /first") {
+			t.Log("\t\tShould receive the response to a request before the next request is sent", tick)
+		} else {
+			t.Errorf("\t\tShould receive the response to a request before the next request is sent, but received %q %v %v", first, err, cross)
+		}
+		io.WriteString(pw, `{"url": "`+upstream.URL+`/second"}`+"\n")
+		pw.Close()
+		second, _ := lines.ReadString('\n')
+		if strings.Contains(second, "GET /second") {
+			t.Log("\t\tShould receive the response to the next request", tick)
+		} else {
+			t.Errorf("\t\tShould receive the response to the next request, but received %q %v", second, cross)
+		}
+		ioutil.ReadAll(lines)
+		if strings.Contains(res.Trailer.Get("Server-Timing"), "total;dur=") {
+			t.Log("\t\tShould receive a summary of the timings as a trailer", tick)
+		} else {
+			t.Errorf("\t\tShould receive a summary of the timings as a trailer, but received %v %v", res.Trailer, cross)
+		}
+	}
+}
+
+func TestNDJSONConcurrency(t *testing.T) {
+	var inFlight, maxInFlight int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&inFlight, 1)
+		for {
+			max := atomic.LoadInt64(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt64(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt64(&inFlight, -1)
+	}))
+	defer upstream.Close()
+
+	defer func(concurrency int) { MaxStreamConcurrency = concurrency }(MaxStreamConcurrency)
+	MaxStreamConcurrency = 2
+
+	t.Log("We should limit the number of requests of batch/ndjson processed at once")
+	{
+		for _, mode := range []string{"parallel", "sequential"} {
+			atomic.StoreInt64(&maxInFlight, 0)
+			content := strings.Repeat(`{"url": "`+upstream.URL+`/"}`+"\n", 8)
+			req := httptest.NewRequest("POST", "/batch/ndjson", strings.NewReader(content))
+			req.Header.Set("Content-Type", "application/x-ndjson")
+			req.Header.Set("x-rrp-mode", mode)
+			rec := httptest.NewRecorder()
+			NDJSON(rec, req)
+
+			expected := int64(2)
+			if mode == "sequential" {
+				expected = 1
+			}
+			if lines := strings.Count(rec.Body.String(), "\n"); lines == 8 && atomic.LoadInt64(&maxInFlight) == expected {
+				t.Logf("\t\tShould process %d %s requests at once %v", expected, mode, tick)
+			} else {
+				t.Errorf("\t\tShould process %d %s requests at once, but processed %d (with %d responses) %v", expected, mode, maxInFlight, lines, cross)
+			}
+		}
+	}
+}
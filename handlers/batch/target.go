@@ -0,0 +1,77 @@
+package batch
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// DefaultSchemes maps hosts to the scheme (http or https) used for the requests in a batch which specify neither
+// an absolute URL nor a Forwarded header with a proto value. Hosts can include a port e.g. `localhost:8080`,
+// otherwise they match the host on any port. The host `*` provides a default for any other hosts.
+var DefaultSchemes = map[string]string{}
+
+// ParseDefaultSchemes parses a comma separated list of host=scheme pairs
+// e.g. `api.example.com=https,localhost:8080=http,*=https` for use as DefaultSchemes
+func ParseDefaultSchemes(value string) (map[string]string, error) {
+	schemes := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid default scheme %q, expected host=scheme", pair)
+		}
+		host, scheme := strings.ToLower(strings.TrimSpace(kv[0])), strings.ToLower(strings.TrimSpace(kv[1]))
+		if scheme != "http" && scheme != "https" {
+			return nil, fmt.Errorf("invalid default scheme %q for %s, expected http or https", scheme, host)
+		}
+		schemes[host] = scheme
+	}
+	return schemes, nil
+}
+
+// defaultScheme returns the default scheme configured for a host (see DefaultSchemes) or an empty string if there is none
+func defaultScheme(host string) string {
+	host = strings.ToLower(host)
+	if scheme, ok := DefaultSchemes[host]; ok {
+		return scheme
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		if scheme, ok := DefaultSchemes[hostname]; ok {
+			return scheme
+		}
+	}
+	return DefaultSchemes["*"]
+}
+
+// partURL works out the URL to send a part's request to. The protocol and host are taken from (in order of precedence)
+// an absolute-form request line e.g. `GET https://api.example.com/x HTTP/1.1`, the part's Forwarded header
+// or the default scheme for the part's Host header (see DefaultSchemes).
+// If the URL cannot be worked out the returned error is accompanied by a machine-readable code for the reason.
+func partURL(pr *http.Request) (url string, code string, err error) {
+	// the Forwarded header is always applied (for the X-Forwarded-For header) even if it is not needed for the URL
+	protocol, host, code, err := applyForwarded(pr)
+	if err != nil {
+		return "", code, err
+	}
+	if pr.URL.IsAbs() {
+		if pr.URL.Scheme != "http" && pr.URL.Scheme != "https" {
+			err = fmt.Errorf("invalid scheme %s in absolute-form request line, expected http or https", pr.URL.Scheme)
+			return "", "invalid_part_scheme", err
+		}
+		return pr.RequestURI, "", nil
+	}
+	if protocol == "" {
+		protocol = defaultScheme(host)
+	}
+	if protocol == "" {
+		err = errors.New("missing header in multipart/mixed content, expected each part to contain an absolute-form request line or a Forwarded header with a valid proto value (proto=http or proto=https)")
+		return "", "missing_forwarded_header", err
+	}
+	return protocol + "://" + host + pr.RequestURI, "", nil
+}
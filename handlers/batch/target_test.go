@@ -0,0 +1,87 @@
+package batch
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPartURL(t *testing.T) {
+	readRequest := func(request string) *http.Request {
+		pr, err := http.ReadRequest(bufio.NewReader(strings.NewReader(request)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pr
+	}
+	defer func(schemes map[string]string) { DefaultSchemes = schemes }(DefaultSchemes)
+
+	t.Log("We should be able to work out the URL for a part's request")
+	{
+		DefaultSchemes = map[string]string{"api.example.com": "https", "localhost:8080": "http"}
+		for request, expected := range map[string]string{
+			"GET https://api.example.com/x?y=1 HTTP/1.1\r\n\r\n":                           "https://api.example.com/x?y=1",
+			"GET http://other.example.com/x HTTP/1.1\r\nForwarded: proto=https\r\n\r\n":    "http://other.example.com/x",
+			"GET /x HTTP/1.1\r\nHost: other.example.com\r\nForwarded: proto=https\r\n\r\n": "https://other.example.com/x",
+			"GET /x HTTP/1.1\r\nHost: api.example.com:8443\r\n\r\n":                        "https://api.example.com:8443/x",
+			"GET /x HTTP/1.1\r\nHost: localhost:8080\r\n\r\n":                              "http://localhost:8080/x",
+		} {
+			if url, _, err := partURL(readRequest(request)); err == nil && url == expected {
+				t.Logf("\t\tShould send %q to %s %v", request, expected, tick)
+			} else {
+				t.Errorf("\t\tShould send %q to %s, but received %q %v %v", request, expected, url, err, cross)
+			}
+		}
+	}
+
+	t.Log("We should be able to configure a default scheme for any host")
+	{
+		DefaultSchemes = map[string]string{"*": "https"}
+		if url, _, err := partURL(readRequest("GET /x HTTP/1.1\r\nHost: localhost\r\n\r\n")); err == nil && url == "https://localhost/x" {
+			t.Log("\t\tShould use the default scheme for `*`", tick)
+		} else {
+			t.Errorf("\t\tShould use the default scheme for `*`, but received %q %v %v", url, err, cross)
+		}
+	}
+
+	t.Log("We should receive an error code when the URL cannot be worked out")
+	{
+		DefaultSchemes = map[string]string{}
+		for request, expected := range map[string]string{
+			"GET /x HTTP/1.1\r\nHost: localhost:8080\r\n\r\n":    "missing_forwarded_header",
+			"GET ftp://localhost/x HTTP/1.1\r\n\r\n":             "invalid_part_scheme",
+			"GET /x HTTP/1.1\r\nForwarded: proto=ws\r\n\r\n":     "invalid_forwarded_proto",
+			"GET /x HTTP/1.1\r\nForwarded: proto=\"\r\n\r\n\r\n": "invalid_forwarded_header",
+		} {
+			if _, code, err := partURL(readRequest(request)); err != nil && code == expected {
+				t.Logf("\t\tShould receive %s for %q %v", expected, request, tick)
+			} else {
+				t.Errorf("\t\tShould receive %s for %q, but received %q %v", expected, request, code, cross)
+			}
+		}
+	}
+}
+
+func TestParseDefaultSchemes(t *testing.T) {
+	t.Log("We should be able to parse default schemes")
+	{
+		schemes, err := ParseDefaultSchemes("API.example.com=HTTPS, localhost:8080=http,*=https")
+		if err == nil && len(schemes) == 3 && schemes["api.example.com"] == "https" && schemes["localhost:8080"] == "http" && schemes["*"] == "https" {
+			t.Log("\t\tShould parse the host=scheme pairs", tick)
+		} else {
+			t.Errorf("\t\tShould parse the host=scheme pairs, but received %v %v %v", schemes, err, cross)
+		}
+	}
+
+	t.Log("We should not be able to parse invalid default schemes")
+	{
+		for _, value := range []string{"api.example.com", "api.example.com=ftp", "=https"} {
+			if _, err := ParseDefaultSchemes(value); err != nil {
+				t.Logf("\t\tShould receive an error for %q %v", value, tick)
+			} else {
+				t.Errorf("\t\tShould receive an error for %q %v", value, cross)
+			}
+		}
+	}
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/8legd/RRP/handlers/batch"
+	"github.com/8legd/RRP/processors"
 	"github.com/8legd/RRP/servers/goji"
 )
 
@@ -14,5 +20,121 @@ func main() {
 	}
 	// TODO check bind format is valid - better usage error
 
+	// the optional RRP_DEFAULT_SCHEMES environmental variable configures the scheme used for hosts
+	// when a batched request specifies neither an absolute URL nor a Forwarded header e.g. `api.example.com=https,*=http`
+	if schemes := os.Getenv("RRP_DEFAULT_SCHEMES"); schemes != "" {
+		defaultSchemes, err := batch.ParseDefaultSchemes(schemes)
+		if err != nil {
+			log.Fatal("Invalid RRP_DEFAULT_SCHEMES environmental variable: " + err.Error())
+		}
+		batch.DefaultSchemes = defaultSchemes
+	}
+
+	// the optional RRP_MAX_* environmental variables configure limits on the size of batches (by default there are no limits)
+	batch.MaxParts = int(limit("RRP_MAX_PARTS", "no limit"))
+	batch.MaxPartBodySize = limit("RRP_MAX_PART_BODY_SIZE", "no limit")
+	batch.MaxRequestSize = limit("RRP_MAX_REQUEST_SIZE", "no limit")
+	processors.MaxResponseSize = limit("RRP_MAX_RESPONSE_SIZE", "no limit")
+	// the optional RRP_MAX_STREAM_CONCURRENCY environmental variable configures the number of requests of a batch/ndjson
+	// request processed at once (by default 64)
+	if concurrency := limit("RRP_MAX_STREAM_CONCURRENCY", "the default of "+strconv.Itoa(batch.MaxStreamConcurrency)); concurrency > 0 {
+		batch.MaxStreamConcurrency = int(concurrency)
+	}
+
+	// the optional RRP_LEGACY_ERRORS environmental variable restores returning errors sending batched requests as a 400 (Bad Request)
+	if legacy := os.Getenv("RRP_LEGACY_ERRORS"); legacy != "" {
+		legacyErrors, err := strconv.ParseBool(legacy)
+		if err != nil {
+			log.Fatal("Invalid RRP_LEGACY_ERRORS environmental variable, expected true or false")
+		}
+		processors.LegacyErrors = legacyErrors
+	}
+
+	// the optional RRP_COALESCE environmental variable enables coalescing identical requests sent concurrently by different
+	// batches, with the RRP_COALESCE_* environmental variables configuring which requests are eligible (comma separated lists)
+	if coalesce := os.Getenv("RRP_COALESCE"); coalesce != "" {
+		enabled, err := strconv.ParseBool(coalesce)
+		if err != nil {
+			log.Fatal("Invalid RRP_COALESCE environmental variable, expected true or false")
+		}
+		if enabled {
+			processors.Coalescing = processors.NewCoalescer(processors.CoalesceRules{
+				Methods: list("RRP_COALESCE_METHODS"),
+				Hosts:   list("RRP_COALESCE_HOSTS"),
+				Headers: list("RRP_COALESCE_HEADERS"),
+			})
+		}
+	}
+
+	// the optional RRP_CACHE_SIZE environmental variable enables caching responses up to the specified size in bytes,
+	// held in memory or (with the optional RRP_CACHE_DIR environmental variable) stored on disk in the specified directory
+	if cacheSize := limit("RRP_CACHE_SIZE", "caching disabled"); cacheSize > 0 {
+		if dir := os.Getenv("RRP_CACHE_DIR"); dir != "" {
+			cache, err := processors.NewDiskCache(dir, cacheSize)
+			if err != nil {
+				log.Fatal("Invalid RRP_CACHE_DIR environmental variable: " + err.Error())
+			}
+			processors.Caching = cache
+		} else {
+			processors.Caching = processors.NewCache(cacheSize)
+		}
+		// with the optional RRP_CACHE_STALE_* environmental variables configuring how long stale responses can be served for each host
+		// (when a response has no `stale-while-revalidate` or `stale-if-error` directive) e.g. `api.example.com=30,*=10` in seconds
+		processors.Caching.StaleWhileRevalidate = staleDefaults("RRP_CACHE_STALE_WHILE_REVALIDATE")
+		processors.Caching.StaleIfError = staleDefaults("RRP_CACHE_STALE_IF_ERROR")
+	}
+
+	// the optional RRP_CACHE_WARM environmental variable is the path of a JSON file configuring requests sent in the background
+	// to keep their responses warm in the cache (see processors.WarmConfig)
+	if path := os.Getenv("RRP_CACHE_WARM"); path != "" {
+		if processors.Caching == nil {
+			log.Fatal("Invalid RRP_CACHE_WARM environmental variable, caching must be enabled with RRP_CACHE_SIZE")
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatal("Invalid RRP_CACHE_WARM environmental variable: " + err.Error())
+		}
+		config, err := processors.ParseWarmConfig(data)
+		if err != nil {
+			log.Fatal("Invalid RRP_CACHE_WARM configuration: " + err.Error())
+		}
+		processors.Warming = processors.NewWarmer(config.Warm)
+		processors.Warming.Start()
+	}
+
 	goji.Start(bind)
 }
+
+// list reads an optional comma separated list from an environmental variable
+func list(name string) []string {
+	var values []string
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// staleDefaults reads optional defaults for serving stale responses for each host from an environmental variable
+func staleDefaults(name string) map[string]time.Duration {
+	defaults, err := processors.ParseStaleDefaults(os.Getenv(name))
+	if err != nil {
+		log.Fatal("Invalid " + name + " environmental variable: " + err.Error())
+	}
+	return defaults
+}
+
+// limit reads an optional limit (e.g. a number of parts or bytes) from an environmental variable, returning zero if it
+// is not set. What zero means (e.g. no limit) is described by zero for the error if the value is invalid.
+func limit(name string, zero string) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	l, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || l < 0 {
+		log.Fatal("Invalid " + name + " environmental variable, expected a non-negative whole number (0 for " + zero + ")")
+	}
+	return l
+}
@@ -2,9 +2,11 @@ package processors
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptrace"
 	"strconv"
 	"sync"
 	"time"
@@ -15,6 +17,54 @@ type batchedRequest struct {
 	Request  *http.Request
 }
 
+// Mode specifies how the requests in a batch are executed
+type Mode string
+
+const (
+	// ModeParallel executes all the requests in a batch concurrently (the default)
+	ModeParallel Mode = "parallel"
+	// ModeSequential executes the requests in a batch one at a time in sequence
+	ModeSequential Mode = "sequential"
+	// ModeSequentialStopOnError executes the requests in a batch one at a time in sequence
+	// until a request fails, the rest of the requests are then not executed
+	ModeSequentialStopOnError Mode = "sequential-stop-on-error"
+)
+
+// BatchOptions is a simple type to provide optional parameters to ProcessBatch and StreamBatch
+type BatchOptions struct {
+	// Mode specifies how the requests in the batch are executed, if not specified they are executed in parallel
+	Mode Mode
+	// Deadline, if specified, caps the total time taken to process the batch
+	// (any requests still waiting to be sent once it has passed fail with a timeout)
+	Deadline time.Time
+	// KeepEncoding, if true, asks for compressed responses (unless a request specifies its own `Accept-Encoding` header)
+	// and passes their bodies through verbatim rather than them being decompressed
+	KeepEncoding bool
+	// Parts provides optional parameters for the individual requests in the batch (in the same sequence as the requests)
+	Parts []PartOptions
+	// refresh, if true, sends the requests even if fresh responses are stored in the cache so that the stored responses
+	// are revalidated or fetched again (used by Warmer to refresh responses before they expire)
+	refresh bool
+}
+
+// PartOptions is a simple type to provide optional parameters for an individual request in a batch
+type PartOptions struct {
+	// ID identifies the request so that values from its response can be referenced by later requests in the batch
+	// e.g. `${ID.status}`, `${ID.header.Location}` or `${ID.body.path.to.value}` (see resolveReferences)
+	ID string
+	// DependsOn lists the sequences of earlier requests in the batch which must succeed before the request is sent.
+	// (Any earlier requests referenced by the request are added to its dependencies automatically)
+	DependsOn []int
+	// Timeout, if specified, is used for the request instead of the timeout for the batch
+	Timeout time.Duration
+	// Response, if specified, is used as the response for the request rather than sending it
+	// (e.g. an error response for a request which was malformed)
+	Response *BatchedResponse
+	// AlwaysSend, if true, means the request is sent even if there is an identical request in the batch
+	// and its response is not used for any other request (e.g. a request in a changeset)
+	AlwaysSend bool
+}
+
 // BatchedResponse is a simple type used as a container for the HTTP responses returned by ProcessBatch
 type BatchedResponse struct {
 	Sequence           int
@@ -23,6 +73,40 @@ type BatchedResponse struct {
 	Header             *http.Header
 	Body               *bytes.Reader
 	ProcessingDuration time.Duration
+	// (new fields are added at the end so that the order of the original fields is kept)
+	StatusCode int
+	// Started is when the request was sent (zero if it was not sent)
+	Started time.Time
+	// Timings is the breakdown of ProcessingDuration (zero if the request was not sent)
+	Timings Timings
+	// Deduplicated is true if the response is a copy of the response to an earlier identical request in the batch
+	// (so the request itself was not sent)
+	Deduplicated bool
+}
+
+// ErrorCodeHeader is the header used to return a machine-readable reason for an individual request which failed
+const ErrorCodeHeader = "x-rrp-error-code"
+
+// ErrorResponse creates a BatchedResponse for an individual request which could not be processed (e.g. because it is malformed)
+// The machine-readable reason is returned in the `x-rrp-error-code` header and as a JSON body along with the error message
+// e.g. `{"error": {"code": "timeout", "message": "net/http: timeout awaiting response headers"}}`
+func ErrorResponse(sequence int, proto string, statusCode int, code string, err error) *BatchedResponse {
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json; charset=utf-8")
+	header.Set(ErrorCodeHeader, code)
+	body := newErrorBody(code, err)
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	return &BatchedResponse{
+		Sequence:   sequence,
+		Status:     strconv.Itoa(statusCode) + " " + http.StatusText(statusCode),
+		StatusCode: statusCode,
+		Proto:      proto,
+		Header:     &header,
+		Body:       bytes.NewReader(body),
+	}
 }
 
 func checkUserAgent(request *http.Request) {
@@ -35,7 +119,7 @@ func checkUserAgent(request *http.Request) {
 	}
 }
 
-func sendErrorResponse(sequence int, proto string, err error, timeout time.Duration, startedProcessing time.Time, batchedResponses chan BatchedResponse) {
+func errorResponse(sequence int, proto string, err error, timeout time.Duration, startedProcessing time.Time) BatchedResponse {
 	// Return an error response - Status 400 (Bad Request)
 	e := err
 	if time.Since(startedProcessing) > timeout {
@@ -45,27 +129,163 @@ func sendErrorResponse(sequence int, proto string, err error, timeout time.Durat
 	errResponse.Proto = proto
 	errResponse.StatusCode = http.StatusBadRequest
 	errResponse.Status = strconv.Itoa(http.StatusBadRequest) + " " + e.Error()
-	batchedResponses <- BatchedResponse{sequence, errResponse.Status, errResponse.Proto, &errResponse.Header, nil, time.Since(startedProcessing)}
+	return BatchedResponse{
+		Sequence:           sequence,
+		Status:             errResponse.Status,
+		StatusCode:         errResponse.StatusCode,
+		Proto:              errResponse.Proto,
+		Header:             &errResponse.Header,
+		ProcessingDuration: time.Since(startedProcessing),
+		Started:            startedProcessing,
+	}
+}
+
+// responseTooLarge returns a 502 (Bad Gateway) for a response which exceeds MaxResponseSize
+func responseTooLarge(sequence int, proto string, startedProcessing time.Time) BatchedResponse {
+	err := fmt.Errorf("response exceeds the maximum size of %d bytes", MaxResponseSize)
+	response := ErrorResponse(sequence, proto, http.StatusBadGateway, "response_too_large", err)
+	response.ProcessingDuration, response.Started = time.Since(startedProcessing), startedProcessing
+	return *response
 }
 
 // ProcessBatch sends a batch of HTTP requests using http.Client.
-// Each request is sent concurrently in a seperate goroutine.
+// Each request is sent concurrently in a seperate goroutine (once any requests it depends on have completed).
+// Unless the batch is sequential, identical idempotent requests are only sent once, each getting a copy of the response (see dedupKey).
 // The HTTP responses are returned in the same sequence as their corresponding requests.
-func ProcessBatch(requests []*http.Request, timeout time.Duration) ([]*BatchedResponse, error) {
+// The options for the batch are optional (only the first is used) so that it can still be called without them.
+func ProcessBatch(requests []*http.Request, timeout time.Duration, options ...BatchOptions) ([]*BatchedResponse, error) {
+	z := len(requests)
+	var batchOptions BatchOptions
+	if len(options) > 0 {
+		batchOptions = options[0]
+	}
+	batchedResponses := StreamBatch(requests, timeout, batchOptions)
+	// Return the BatchedResponses in their correct sequence
+	responses := make([]*BatchedResponse, z)
+	received := 0
+	for r := range batchedResponses {
+		response := r
+		responses[r.Sequence] = &response
+		received++
+	}
+	// Check we have the correct number of BatchedResponses
+	if received != z {
+		err := fmt.Errorf("expected %d responses for this batch but only recieved %d", z, received)
+		return nil, err
+	}
+	return responses, nil
+}
+
+// batchState is the state shared by the goroutines processing the requests of a batch in StreamBatch
+type batchState struct {
+	timeout      time.Duration
+	deadline     time.Time
+	keepEncoding bool
+	refresh      bool
+	parts        []PartOptions
+	dependencies [][]int
+	// processed has a channel for each request which is closed once it has been processed
+	// (so any requests which depend on it know when they can proceed) and results holds its response
+	processed []chan struct{}
+	results   []BatchedResponse
+}
+
+// StreamBatch sends a batch of HTTP requests using http.Client in the same way as ProcessBatch.
+// However rather than waiting for all the HTTP responses, each response is sent on the returned
+// channel as soon as it has been received (tagged with the sequence of its corresponding request).
+// The channel is closed once all the requests have been processed.
+func StreamBatch(requests []*http.Request, timeout time.Duration, options BatchOptions) <-chan BatchedResponse {
 	z := len(requests)
-	// Setup a buffered channel to queue up the requests for processing by individual HTTP Client goroutines
-	batchedRequests := make(chan batchedRequest, z)
+	b := &batchState{
+		timeout:      timeout,
+		deadline:     options.Deadline,
+		keepEncoding: options.KeepEncoding,
+		refresh:      options.refresh,
+		parts:        make([]PartOptions, z),
+		dependencies: make([][]int, z),
+		processed:    make([]chan struct{}, z),
+		results:      make([]BatchedResponse, z),
+	}
+	copy(b.parts, options.Parts)
+	// Work out the dependencies of each request (including any implied by references to earlier requests)
+	invalid := make([]error, z)
 	for i := 0; i < z; i++ {
-		batchedRequests <- batchedRequest{i, requests[i]}
+		b.processed[i] = make(chan struct{})
+		if b.parts[i].Response == nil {
+			b.dependencies[i], invalid[i] = findDependencies(i, requests[i], b.parts)
+			// when stopping on error each request depends on the previous request in the batch succeeding
+			if options.Mode == ModeSequentialStopOnError && i > 0 {
+				b.dependencies[i] = append(b.dependencies[i], i-1)
+			}
+		}
 	}
-	// Close the channel - nothing else is sent to it
-	close(batchedRequests)
-	// Setup a second buffered channel for collecting the BatchedResponses from the individual HTTP Client goroutines
+	// Identical requests are only sent once (see dedupKey) with each getting a copy of the response
+	// (unless the batch is sequential as then a request may depend on the side effects of earlier requests)
+	duplicateOf := findDuplicates(requests, b.parts, b.dependencies, invalid, options.Mode != ModeSequential && options.Mode != ModeSequentialStopOnError)
+	// Setup a buffered channel for collecting the BatchedResponses from the individual HTTP Client goroutines
 	batchedResponses := make(chan BatchedResponse, z)
-	// Setup a wait group so we know when all the BatchedRequests have been processed
+	// Setup a wait group so we know when all the requests have been processed
 	var wg sync.WaitGroup
 	wg.Add(z)
 
+	// Start our individual HTTP Client goroutines to process the requests
+	for i := 0; i < z; i++ {
+		go func(r batchedRequest) {
+			defer wg.Done()
+			defer close(b.processed[r.Sequence])
+
+			// when sequential each request waits for the previous request in the batch to be processed
+			if options.Mode == ModeSequential && r.Sequence > 0 {
+				<-b.processed[r.Sequence-1]
+			}
+			var response BatchedResponse
+			switch {
+			case b.parts[r.Sequence].Response != nil:
+				response = *b.parts[r.Sequence].Response
+				response.Sequence = r.Sequence
+			case invalid[r.Sequence] != nil:
+				response = *ErrorResponse(r.Sequence, r.Request.Proto, http.StatusBadRequest, "invalid_dependency", invalid[r.Sequence])
+			case duplicateOf[r.Sequence] >= 0:
+				response = b.duplicateResponse(r.Sequence, duplicateOf[r.Sequence])
+			default:
+				response = b.processDependentRequest(r)
+			}
+			b.results[r.Sequence] = response
+			batchedResponses <- response
+		}(batchedRequest{i, requests[i]})
+	}
+
+	// Wait for all the requests to be processed
+	go func() {
+		wg.Wait()
+		// Close the buffered channel that we used to collect the BatchedResponses
+		close(batchedResponses)
+	}()
+	return batchedResponses
+}
+
+// processDependentRequest waits for the requests an individual request depends on before processing it.
+// If any of them failed the request is not sent and a 424 (Failed Dependency) response is returned instead.
+func (b *batchState) processDependentRequest(r batchedRequest) BatchedResponse {
+	dependencies := b.dependencies[r.Sequence]
+	for _, d := range dependencies {
+		<-b.processed[d]
+		if b.results[d].StatusCode < 200 || b.results[d].StatusCode >= 400 {
+			err := fmt.Errorf("request not executed as the request it depends on (%d) failed with %s", d, b.results[d].Status)
+			return *ErrorResponse(r.Sequence, r.Request.Proto, http.StatusFailedDependency, "not_executed", err)
+		}
+	}
+	if len(dependencies) > 0 {
+		if err := resolveReferences(r.Request, b.parts, b.results); err != nil {
+			return *ErrorResponse(r.Sequence, r.Request.Proto, http.StatusFailedDependency, "unresolved_reference", err)
+		}
+	}
+
+	// the request's own timeout (if it has one) overrides the timeout for the batch
+	timeout := b.timeout
+	if b.parts[r.Sequence].Timeout > 0 {
+		timeout = b.parts[r.Sequence].Timeout
+	}
 	var client *http.Client
 	if DefaultTimeout == timeout {
 		client = DefaultClient
@@ -73,92 +293,176 @@ func ProcessBatch(requests []*http.Request, timeout time.Duration) ([]*BatchedRe
 		// create a non standard client for the request
 		client = CreateClient(timeout)
 	}
+	// if there is a deadline for the batch the request is given whatever remains of it (if less than its timeout)
+	if !b.deadline.IsZero() {
+		ctx, cancel := context.WithDeadline(r.Request.Context(), b.deadline)
+		defer cancel()
+		r.Request = r.Request.WithContext(ctx)
+		if remaining := time.Until(b.deadline); remaining < timeout {
+			timeout = remaining
+		}
+	}
+	if b.keepEncoding {
+		keepEncoding(r.Request)
+	}
+	// a fresh response stored in the cache is used rather than sending the request (unless it is being refreshed)
+	var stored *cacheEntry
+	if Caching != nil {
+		stored = Caching.lookup(r.Request)
+	}
+	if Caching != nil && !b.refresh {
+		if response, ok := Caching.get(r, stored); ok {
+			return response
+		}
+		// a stale response stored in the cache may be used while it is revalidated in the background
+		if response, ok := Caching.whileRevalidating(r, stored, func(r batchedRequest) BatchedResponse {
+			return processRequest(client, r, timeout, stored)
+		}); ok {
+			return response
+		}
+	}
+	if Coalescing != nil {
+		return Coalescing.do(r, timeout, func() BatchedResponse {
+			return processRequest(client, r, timeout, stored)
+		})
+	}
+	return processRequest(client, r, timeout, stored)
+}
 
-	// Start our individual HTTP Client goroutines to process the BatchedRequests
-	for i := 0; i < z; i++ {
-		go func() {
-			defer wg.Done()
-			r := <-batchedRequests
-			startedProcessing := time.Now()
+// processRequest sends an individual request using http.Client and reads its response, recording the
+// Timings of each phase with httptrace. The timings are also returned in a `Server-Timing` header.
+// If caching is enabled the response is stored in the cache (if it can be) and marked as not served from the cache,
+// unless it revalidates the response stored for the request (see Cache.lookup) or that is served in place of an error.
+func processRequest(client *http.Client, r batchedRequest, timeout time.Duration, stored *cacheEntry) BatchedResponse {
+	startedProcessing := time.Now()
+	trace := newRequestTrace(startedProcessing)
+	r.Request = r.Request.WithContext(httptrace.WithClientTrace(r.Request.Context(), trace.clientTrace()))
+	// a stale response stored in the cache is revalidated with the origin rather than fetched again
+	sent := r
+	if stored != nil {
+		if conditional := stored.conditional(r.Request); conditional != nil {
+			sent.Request = conditional
+		}
+	}
+	response, err := sendRequest(client, sent, timeout, startedProcessing)
+	// (the body of the response has been read by the end of its ProcessingDuration)
+	response.Timings = trace.timings(startedProcessing.Add(response.ProcessingDuration))
+	if stored != nil {
+		var cached BatchedResponse
+		var ok bool
+		if sent.Request != r.Request && response.StatusCode == http.StatusNotModified {
+			cached, ok = Caching.refresh(r.Request, stored, response), true
+		} else {
+			// a stale response can be served in place of an error
+			cached, ok = Caching.ifError(stored, response, err)
+		}
+		if ok {
+			cached.Timings = response.Timings
+			cached.Header.Add(ServerTimingHeader, cached.Timings.ServerTiming(cached.ProcessingDuration))
+			return cached
+		}
+	}
+	if Caching != nil {
+		Caching.put(r.Request, response)
+	}
+	if response.Header == nil {
+		response.Header = &http.Header{}
+	}
+	if *response.Header == nil {
+		*response.Header = http.Header{}
+	}
+	response.Header.Add(ServerTimingHeader, response.Timings.ServerTiming(response.ProcessingDuration))
+	if Caching != nil && Caching.usable(r.Request) {
+		response.Header.Set(CacheHeader, "MISS")
+	}
+	return response
+}
 
-			checkUserAgent(r.Request)
-			response, err := client.Do(r.Request)
+// sendRequest sends an individual request using http.Client and reads its response,
+// also returning the error if it could not be sent (or its response could not be read)
+func sendRequest(client *http.Client, r batchedRequest, timeout time.Duration, startedProcessing time.Time) (BatchedResponse, error) {
+	checkUserAgent(r.Request)
+	response, err := client.Do(r.Request)
 
-			// Defer closing of underlying connection so it can be re-used
-			defer func() {
-				if response != nil && response.Body != nil {
-					response.Body.Close()
-				}
-			}()
-			if err != nil {
-				sendErrorResponse(r.Sequence, r.Request.Proto, err, timeout, startedProcessing, batchedResponses)
-				return
-			}
-			// If there is no body to read we are done
-			if response.Body == nil {
-				batchedResponses <- BatchedResponse{r.Sequence, response.Status, response.Proto, &response.Header, nil, time.Since(startedProcessing)}
-				return
-			}
-			// Create a buffer to hold the data
-			var buffy bytes.Buffer
-
-			// Read the response
-			// TODO chunkSize should be configurable
-			chunkSize := 16384
-			if response.ContentLength > 0 && response.ContentLength < int64(chunkSize) {
-				chunkSize = int(response.ContentLength)
-			}
-			for {
-				chunk := make([]byte, chunkSize)
-				lastReadLength, err := response.Body.Read(chunk)
+	// Defer closing of underlying connection so it can be re-used
+	defer func() {
+		if response != nil && response.Body != nil {
+			response.Body.Close()
+		}
+	}()
+	if err != nil {
+		return transportErrorResponse(r.Sequence, r.Request.Proto, err, timeout, startedProcessing), err
+	}
+	// If there is no body to read we are done
+	// (responses to HEAD requests never have a body even if they include a Content-Length header)
+	if response.Body == nil || r.Request.Method == http.MethodHead {
+		normaliseFraming(response, nil, r.Request.Method)
+		return BatchedResponse{
+			Sequence:           r.Sequence,
+			Status:             response.Status,
+			StatusCode:         response.StatusCode,
+			Proto:              response.Proto,
+			Header:             &response.Header,
+			ProcessingDuration: time.Since(startedProcessing),
+			Started:            startedProcessing,
+		}, nil
+	}
+	// Check the response is not too large to buffer (see MaxResponseSize)
+	if MaxResponseSize > 0 && response.ContentLength > MaxResponseSize {
+		return responseTooLarge(r.Sequence, response.Proto, startedProcessing), nil
+	}
+	// Create a buffer to hold the data
+	var buffy bytes.Buffer
 
-				if err != nil && err != io.EOF { // return on error in read
-					sendErrorResponse(r.Sequence, response.Proto, err, timeout, startedProcessing, batchedResponses)
-					return
-				}
+	// Read the response
+	// TODO chunkSize should be configurable
+	chunkSize := 16384
+	if response.ContentLength > 0 && response.ContentLength < int64(chunkSize) {
+		chunkSize = int(response.ContentLength)
+	}
+	for {
+		chunk := make([]byte, chunkSize)
+		lastReadLength, err := response.Body.Read(chunk)
 
-				if lastReadLength > 0 && lastReadLength < chunkSize {
-					chunk = chunk[0:lastReadLength]
-				}
-				if lastReadLength < 1 || err == io.EOF { // return on success (finished reading without error)
-					if lastReadLength > 0 {
-						_, err = buffy.Write(chunk)
-
-						if err != nil { // return on error in write to buffer
-							sendErrorResponse(r.Sequence, response.Proto, err, timeout, startedProcessing, batchedResponses)
-							return
-						}
-					}
-					io.WriteString(&buffy, "\r\n") // success
-					batchedResponses <- BatchedResponse{r.Sequence, response.Status, response.Proto, &response.Header, bytes.NewReader(buffy.Bytes()), time.Since(startedProcessing)}
-					return
-				}
+		if err != nil && err != io.EOF { // return on error in read
+			return transportErrorResponse(r.Sequence, response.Proto, err, timeout, startedProcessing), err
+		}
 
-				_, err = buffy.Write(chunk) // write next chunk, and keep reading in loop
+		if lastReadLength > 0 && lastReadLength < chunkSize {
+			chunk = chunk[0:lastReadLength]
+		}
+		if lastReadLength < 1 || err == io.EOF { // return on success (finished reading without error)
+			if lastReadLength > 0 {
+				_, err = buffy.Write(chunk)
 
-				if err != nil { // return on error in write
-					sendErrorResponse(r.Sequence, response.Proto, err, timeout, startedProcessing, batchedResponses)
-					return
+				if err != nil { // return on error in write to buffer
+					return transportErrorResponse(r.Sequence, response.Proto, err, timeout, startedProcessing), err
 				}
 			}
+			if MaxResponseSize > 0 && int64(buffy.Len()) > MaxResponseSize {
+				return responseTooLarge(r.Sequence, response.Proto, startedProcessing), nil
+			}
+			// success
+			normaliseFraming(response, buffy.Bytes(), r.Request.Method)
+			return BatchedResponse{
+				Sequence:           r.Sequence,
+				Status:             response.Status,
+				StatusCode:         response.StatusCode,
+				Proto:              response.Proto,
+				Header:             &response.Header,
+				Body:               bytes.NewReader(buffy.Bytes()),
+				ProcessingDuration: time.Since(startedProcessing),
+				Started:            startedProcessing,
+			}, nil
+		}
 
-		}()
-	}
+		_, err = buffy.Write(chunk) // write next chunk, and keep reading in loop
 
-	// Wait for all the requests to be processed
-	wg.Wait()
-	// Close the second buffered channel that we used to collect the BatchedResponses
-	close(batchedResponses)
-	// Check we have the correct number of BatchedResponses
-	if len(batchedResponses) == z {
-		// Return the BatchedResponses in their correct sequence
-		responses := make([]*BatchedResponse, z)
-		for i := 0; i < z; i++ {
-			r := <-batchedResponses
-			responses[r.Sequence] = &r
+		if err != nil { // return on error in write
+			return transportErrorResponse(r.Sequence, response.Proto, err, timeout, startedProcessing), err
+		}
+		if MaxResponseSize > 0 && int64(buffy.Len()) > MaxResponseSize { // return once the response is too large
+			return responseTooLarge(r.Sequence, response.Proto, startedProcessing), nil
 		}
-		return responses, nil
 	}
-	err := fmt.Errorf("expected %d responses for this batch but only recieved %d", z, len(batchedResponses))
-	return nil, err
 }
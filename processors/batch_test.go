@@ -0,0 +1,508 @@
+package processors
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const tick = "\u2713"
+const cross = "\u2717"
+
+func body(response *BatchedResponse) string {
+	if response == nil || response.Body == nil {
+		return ""
+	}
+	b, _ := ioutil.ReadAll(response.Body)
+	return string(b)
+}
+
+// waitTimeout is how long a test waits for something to happen in the background before failing
+// (it is generous as it is only reached if the test is failing)
+const waitTimeout = 30 * time.Second
+
+// waitFor waits for a condition to be met (e.g. by requests in the background), failing the test if it is not
+// met within the waitTimeout
+func waitFor(t *testing.T, condition func() bool, should string) {
+	t.Helper()
+	timeout := time.After(waitTimeout)
+	for !condition() {
+		select {
+		case <-timeout:
+			t.Fatalf("\t\tShould %s, but timed out %v", should, cross)
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// waitForSignal waits for a signal (e.g. from a test server once it receives a request), failing the test if it is not
+// received within the waitTimeout
+func waitForSignal(t *testing.T, signal <-chan struct{}, should string) {
+	t.Helper()
+	select {
+	case <-signal:
+	case <-time.After(waitTimeout):
+		t.Fatalf("\t\tShould %s, but timed out %v", should, cross)
+	}
+}
+
+func TestProcessBatchDependencies(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/items":
+			w.Header().Set("Location", "/items/42")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"data": {"id": 42, "name": "Bob"}}`))
+		case "/missing":
+			http.NotFound(w, r)
+		case "/hosted/201":
+			w.Write([]byte(r.Host))
+		case "/query":
+			w.Write([]byte(r.URL.RawQuery))
+		case "/tricky":
+			w.Write([]byte(`{"name": "Bob \"The Builder\"", "path": "a/b?c&d"}`))
+		default:
+			b, _ := ioutil.ReadAll(r.Body)
+			w.Write([]byte(r.Method + " " + r.URL.EscapedPath() + " " + r.Header.Get("x-location") + " " + string(b)))
+		}
+	}))
+	defer upstream.Close()
+
+	t.Log("We should be able to process a batch with dependencies between requests")
+	{
+		create, _ := http.NewRequest("POST", upstream.URL+"/items", strings.NewReader("Bob"))
+		update, _ := http.NewRequest("PUT", upstream.URL+"/items/${create.body.data.id}", strings.NewReader(`{"name": "${create.body.data.name}"}`))
+		update.Header.Set("x-location", "${create.header.Location}")
+		missing, _ := http.NewRequest("GET", upstream.URL+"/missing", nil)
+		dependent, _ := http.NewRequest("GET", upstream.URL+"/dependent", nil)
+		independent, _ := http.NewRequest("GET", upstream.URL+"/independent/${unknown.status}", nil)
+		hosted, _ := http.NewRequest("GET", upstream.URL+"/hosted/${create.status}", nil)
+		hosted.Host = "api.example.com"
+
+		responses, err := ProcessBatch([]*http.Request{create, update, missing, dependent, independent, hosted}, DefaultTimeout, BatchOptions{
+			Parts: []PartOptions{{ID: "create"}, {}, {ID: "missing"}, {DependsOn: []int{2}}, {}, {}},
+		})
+		if err != nil {
+			t.Fatalf("\t\tShould process the batch, but received %s %v", err, cross)
+		}
+
+		if b := body(responses[1]); b == `PUT /items/42 /items/42 {"name": "Bob"}` {
+			t.Log("\t\tShould resolve references to earlier responses in the URL, headers and body", tick)
+		} else {
+			t.Errorf("\t\tShould resolve references to earlier responses in the URL, headers and body, but received %q %v", b, cross)
+		}
+		if responses[3].StatusCode == http.StatusFailedDependency && responses[3].Header.Get(ErrorCodeHeader) == "not_executed" {
+			t.Log("\t\tShould not execute requests which depend on a failed request", tick)
+		} else {
+			t.Errorf("\t\tShould not execute requests which depend on a failed request, but received %s %v", responses[3].Status, cross)
+		}
+		if responses[4].StatusCode == http.StatusOK {
+			t.Log("\t\tShould leave references to unknown ids as is", tick)
+		} else {
+			t.Errorf("\t\tShould leave references to unknown ids as is, but received %s %v", responses[4].Status, cross)
+		}
+		if b := body(responses[5]); b == "api.example.com" {
+			t.Log("\t\tShould keep the Host header of a request when resolving references", tick)
+		} else {
+			t.Errorf("\t\tShould keep the Host header of a request when resolving references, but received %q %v", b, cross)
+		}
+	}
+
+	t.Log("We should escape the values referenced for where they are in a request")
+	{
+		tricky, _ := http.NewRequest("GET", upstream.URL+"/tricky", nil)
+		path, _ := http.NewRequest("GET", upstream.URL+"/paths/${tricky.body.path}", nil)
+		query, _ := http.NewRequest("GET", upstream.URL+"/query?path=${tricky.body.path}&name=${tricky.body.name}", nil)
+		jsonBody, _ := http.NewRequest("POST", upstream.URL+"/json", strings.NewReader(`{"name": "${tricky.body.name}", "path": ${tricky.body.path}}`))
+		jsonBody.Header.Set("Content-Type", "application/json")
+		responses, _ := ProcessBatch([]*http.Request{tricky, path, query, jsonBody}, DefaultTimeout, BatchOptions{
+			Parts: []PartOptions{{ID: "tricky"}, {}, {}, {}},
+		})
+
+		if b := body(responses[1]); b == "GET /paths/a%2Fb%3Fc&d  " {
+			t.Log("\t\tShould path escape a value referenced in the path of the URL", tick)
+		} else {
+			t.Errorf("\t\tShould path escape a value referenced in the path of the URL, but received %q %v", b, cross)
+		}
+		if b := body(responses[2]); b == "path=a%2Fb%3Fc%26d&name=Bob+%22The+Builder%22" {
+			t.Log("\t\tShould query escape a value referenced in the query of the URL", tick)
+		} else {
+			t.Errorf("\t\tShould query escape a value referenced in the query of the URL, but received %q %v", b, cross)
+		}
+		b := body(responses[3])
+		var sent struct{ Name, Path string }
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(b, "POST /json  ")), &sent); err == nil && sent.Name == `Bob "The Builder"` && sent.Path == "a/b?c&d" {
+			t.Log("\t\tShould escape a value referenced in a JSON body so that it is still valid JSON", tick)
+		} else {
+			t.Errorf("\t\tShould escape a value referenced in a JSON body so that it is still valid JSON, but received %q %v", b, cross)
+		}
+	}
+
+	t.Log("We should not be able to depend on later requests in a batch")
+	{
+		first, _ := http.NewRequest("GET", upstream.URL+"/first/${second.status}", nil)
+		second, _ := http.NewRequest("GET", upstream.URL+"/second", nil)
+		responses, err := ProcessBatch([]*http.Request{first, second}, DefaultTimeout, BatchOptions{
+			Parts: []PartOptions{{ID: "first"}, {ID: "second"}},
+		})
+		if err == nil && responses[0].StatusCode == http.StatusBadRequest && responses[0].Header.Get(ErrorCodeHeader) == "invalid_dependency" {
+			t.Log("\t\tShould receive an invalid_dependency error response", tick)
+		} else {
+			t.Errorf("\t\tShould receive an invalid_dependency error response, but received %v %v", responses[0], cross)
+		}
+	}
+}
+
+func TestProcessBatchModes(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		mu.Lock()
+		received = append(received, r.URL.Path)
+		mu.Unlock()
+		if r.URL.Path == "/fail" {
+			http.Error(w, "oops", http.StatusInternalServerError)
+		}
+	}))
+	defer upstream.Close()
+
+	newBatch := func(paths ...string) []*http.Request {
+		mu.Lock()
+		received = nil
+		mu.Unlock()
+		var requests []*http.Request
+		for _, path := range paths {
+			request, _ := http.NewRequest("GET", upstream.URL+path, nil)
+			requests = append(requests, request)
+		}
+		return requests
+	}
+	// sent returns the paths of the requests received by upstream so far (in the order they were received)
+	sent := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return strings.Join(received, ",")
+	}
+
+	t.Log("We should be able to process a batch in parallel")
+	{
+		// (without any options as the requests are processed in parallel by default)
+		ProcessBatch(newBatch("/slow", "/fast"), DefaultTimeout)
+		if sent() == "/fast,/slow" {
+			t.Log("\t\tShould send the requests concurrently", tick)
+		} else {
+			t.Errorf("\t\tShould send the requests concurrently, but received %v %v", sent(), cross)
+		}
+	}
+
+	t.Log("We should be able to process a batch sequentially")
+	{
+		responses, _ := ProcessBatch(newBatch("/slow", "/fail", "/fast"), DefaultTimeout, BatchOptions{Mode: ModeSequential})
+		if sent() == "/slow,/fail,/fast" && responses[2].StatusCode == http.StatusOK {
+			t.Log("\t\tShould send the requests one at a time in sequence", tick)
+		} else {
+			t.Errorf("\t\tShould send the requests one at a time in sequence, but received %v %v", sent(), cross)
+		}
+	}
+
+	t.Log("We should be able to process a batch sequentially stopping on error")
+	{
+		responses, _ := ProcessBatch(newBatch("/slow", "/fail", "/fast", "/fast"), DefaultTimeout, BatchOptions{Mode: ModeSequentialStopOnError})
+		if sent() == "/slow,/fail" &&
+			responses[2].StatusCode == http.StatusFailedDependency && responses[2].Header.Get(ErrorCodeHeader) == "not_executed" &&
+			responses[3].StatusCode == http.StatusFailedDependency && responses[3].Header.Get(ErrorCodeHeader) == "not_executed" {
+			t.Log("\t\tShould not execute the requests after the failed request", tick)
+		} else {
+			t.Errorf("\t\tShould not execute the requests after the failed request, but received %v %v", sent(), cross)
+		}
+	}
+}
+
+func TestProcessBatchTimeouts(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d, err := time.ParseDuration(r.URL.Query().Get("sleep")); err == nil {
+			time.Sleep(d)
+		}
+	}))
+	defer upstream.Close()
+
+	newRequest := func(sleep string) *http.Request {
+		request, _ := http.NewRequest("GET", upstream.URL+"/?sleep="+sleep, nil)
+		return request
+	}
+
+	t.Log("We should be able to specify a timeout for an individual request")
+	{
+		responses, _ := ProcessBatch([]*http.Request{newRequest("200ms"), newRequest("200ms")}, DefaultTimeout, BatchOptions{
+			Parts: []PartOptions{{Timeout: 50 * time.Millisecond}, {}},
+		})
+		if responses[0].StatusCode == http.StatusGatewayTimeout && responses[0].Header.Get(ErrorCodeHeader) == "timeout" && responses[1].StatusCode == http.StatusOK {
+			t.Log("\t\tShould only time out the request with the shorter timeout", tick)
+		} else {
+			t.Errorf("\t\tShould only time out the request with the shorter timeout, but received %s and %s %v", responses[0].Status, responses[1].Status, cross)
+		}
+	}
+
+	t.Log("We should be able to specify a deadline for a batch")
+	{
+		started := time.Now()
+		responses, _ := ProcessBatch([]*http.Request{newRequest("10ms"), newRequest("500ms"), newRequest("10ms")}, DefaultTimeout, BatchOptions{
+			Mode:     ModeSequential,
+			Deadline: started.Add(100 * time.Millisecond),
+		})
+		if responses[0].StatusCode == http.StatusOK && responses[1].StatusCode == http.StatusGatewayTimeout && responses[2].StatusCode == http.StatusGatewayTimeout && time.Since(started) < 300*time.Millisecond {
+			t.Log("\t\tShould time out the requests still in progress once the deadline has passed", tick)
+		} else {
+			t.Errorf("\t\tShould time out the requests still in progress once the deadline has passed, but received %s, %s and %s after %s %v", responses[0].Status, responses[1].Status, responses[2].Status, time.Since(started), cross)
+		}
+	}
+}
+
+func TestProcessBatchErrors(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer upstream.Close()
+	tlsUpstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsUpstream.Close()
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+
+	newRequests := func(urls ...string) []*http.Request {
+		var requests []*http.Request
+		for _, u := range urls {
+			request, _ := http.NewRequest("GET", u, nil)
+			requests = append(requests, request)
+		}
+		return requests
+	}
+
+	t.Log("We should receive meaningful status codes for requests which fail")
+	{
+		responses, _ := ProcessBatch(newRequests(upstream.URL, closed.URL, "http://rrp.invalid/", tlsUpstream.URL), DefaultTimeout, BatchOptions{
+			Parts: []PartOptions{{Timeout: 50 * time.Millisecond}},
+		})
+		for i, expected := range []struct {
+			statusCode int
+			code       string
+		}{
+			{http.StatusGatewayTimeout, "timeout"},
+			{http.StatusBadGateway, "connection_refused"},
+			{http.StatusBadGateway, "dns_error"},
+			{http.StatusBadGateway, "tls_error"},
+		} {
+			if responses[i].StatusCode == expected.statusCode && responses[i].Header.Get(ErrorCodeHeader) == expected.code &&
+				strings.Contains(body(responses[i]), `"code":"`+expected.code+`"`) {
+				t.Logf("\t\tShould receive %d with code %s %v", expected.statusCode, expected.code, tick)
+			} else {
+				t.Errorf("\t\tShould receive %d with code %s, but received %s %q %v", expected.statusCode, expected.code, responses[i].Status, responses[i].Header.Get(ErrorCodeHeader), cross)
+			}
+		}
+	}
+
+	t.Log("We should be able to receive errors as a 400 (Bad Request) for compatibility")
+	{
+		LegacyErrors = true
+		defer func() { LegacyErrors = false }()
+		responses, _ := ProcessBatch(newRequests(closed.URL), DefaultTimeout, BatchOptions{})
+		if responses[0].StatusCode == http.StatusBadRequest && strings.HasPrefix(responses[0].Status, "400 ") && responses[0].Header.Get(ErrorCodeHeader) == "" {
+			t.Log("\t\tShould receive the error as the status of a 400 (Bad Request)", tick)
+		} else {
+			t.Errorf("\t\tShould receive the error as the status of a 400 (Bad Request), but received %s %v", responses[0].Status, cross)
+		}
+	}
+}
+
+func TestProcessBatchFraming(t *testing.T) {
+	content := strings.Repeat("Hello Bob ", 100)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			zw.Write([]byte(content))
+			zw.Close()
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+			w.Write(buf.Bytes())
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	defer upstream.Close()
+
+	newRequests := func(acceptEncoding string) []*http.Request {
+		request, _ := http.NewRequest("GET", upstream.URL, nil)
+		if acceptEncoding != "" {
+			request.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		return []*http.Request{request}
+	}
+
+	t.Log("We should receive framing headers matching the body of each response")
+	{
+		// (as the request has no Accept-Encoding header the compressed response is decompressed by the transport)
+		responses, _ := ProcessBatch(newRequests(""), DefaultTimeout, BatchOptions{})
+		b := body(responses[0])
+		if b == content && responses[0].Header.Get("Content-Length") == strconv.Itoa(len(content)) && responses[0].Header.Get("Content-Encoding") == "" {
+			t.Log("\t\tShould set the Content-Length of a decompressed response", tick)
+		} else {
+			t.Errorf("\t\tShould set the Content-Length of a decompressed response, but received %v %v", responses[0].Header, cross)
+		}
+	}
+
+	t.Log("We should be able to keep the encoding of compressed responses")
+	{
+		for _, options := range []struct {
+			acceptEncoding string
+			keepEncoding   bool
+		}{{"gzip", false}, {"", true}} {
+			responses, _ := ProcessBatch(newRequests(options.acceptEncoding), DefaultTimeout, BatchOptions{KeepEncoding: options.keepEncoding})
+			b := body(responses[0])
+			zr, err := gzip.NewReader(strings.NewReader(b))
+			if err == nil && responses[0].Header.Get("Content-Encoding") == "gzip" && responses[0].Header.Get("Content-Length") == strconv.Itoa(len(b)) {
+				decompressed, _ := ioutil.ReadAll(zr)
+				if string(decompressed) == content {
+					t.Logf("\t\tShould pass the compressed body through verbatim with KeepEncoding %t and Accept-Encoding %q %v", options.keepEncoding, options.acceptEncoding, tick)
+					continue
+				}
+			}
+			t.Errorf("\t\tShould pass the compressed body through verbatim with KeepEncoding %t and Accept-Encoding %q, but received %v %v", options.keepEncoding, options.acceptEncoding, responses[0].Header, cross)
+		}
+	}
+}
+
+func TestProcessBatchTimings(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+	defer upstream.Close()
+
+	t.Log("We should receive the timings of each phase of a request")
+	{
+		// (the host is looked up so there is a DNS phase)
+		request, _ := http.NewRequest("GET", strings.Replace(upstream.URL, "127.0.0.1", "localhost", 1), nil)
+		responses, err := ProcessBatch([]*http.Request{request}, DefaultTimeout, BatchOptions{})
+		if err != nil {
+			t.Fatalf("\t\tShould receive a response, but received %s %v", err, cross)
+		}
+		timings := responses[0].Timings
+		if timings.DNS > 0 && timings.Connect > 0 && timings.TLS == 0 {
+			t.Log("\t\tShould receive the DNS and connect timings", tick)
+		} else {
+			t.Errorf("\t\tShould receive the DNS and connect timings, but received %+v %v", timings, cross)
+		}
+		if timings.FirstByte >= 50*time.Millisecond && timings.Transfer >= 50*time.Millisecond && timings.FirstByte+timings.Transfer <= responses[0].ProcessingDuration {
+			t.Log("\t\tShould receive the time to first byte and transfer timings", tick)
+		} else {
+			t.Errorf("\t\tShould receive the time to first byte and transfer timings, but received %+v %v", timings, cross)
+		}
+		serverTiming := responses[0].Header.Get(ServerTimingHeader)
+		if strings.Contains(serverTiming, "dns;dur=") && strings.Contains(serverTiming, "ttfb;dur=") && strings.Contains(serverTiming, "total;dur=") {
+			t.Log("\t\tShould receive the timings in a Server-Timing header", tick)
+		} else {
+			t.Errorf("\t\tShould receive the timings in a Server-Timing header, but received %q %v", serverTiming, cross)
+		}
+	}
+
+	t.Log("We should be able to summarise the timings of a batch")
+	{
+		slowest := SlowestTimings([]*BatchedResponse{
+			{Timings: Timings{DNS: 3 * time.Millisecond, FirstByte: 10 * time.Millisecond}},
+			nil,
+			{Timings: Timings{DNS: 1 * time.Millisecond, FirstByte: 20 * time.Millisecond, Transfer: 1500 * time.Microsecond}},
+		})
+		if slowest.ServerTiming(25*time.Millisecond) == "dns;dur=3, connect;dur=0, tls;dur=0, ttfb;dur=20, transfer;dur=1.5, total;dur=25" {
+			t.Log("\t\tShould receive the longest time for each phase", tick)
+		} else {
+			t.Errorf("\t\tShould receive the longest time for each phase, but received %q %v", slowest.ServerTiming(25*time.Millisecond), cross)
+		}
+	}
+}
+
+func TestProcessBatchDeduplication(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		call := calls
+		mu.Unlock()
+		w.Header().Set("Vary", "Accept")
+		w.Write([]byte(r.Method + " " + r.URL.Path + " " + r.Header.Get("Accept") + " " + strconv.Itoa(call)))
+	}))
+	defer upstream.Close()
+
+	newRequest := func(method string, accept string, requestID string) *http.Request {
+		request, _ := http.NewRequest(method, upstream.URL+"/resource", nil)
+		request.Header.Set("Accept", accept)
+		if requestID != "" {
+			request.Header.Set("x-request-id", requestID)
+		}
+		return request
+	}
+
+	t.Log("We should only send identical idempotent requests once")
+	{
+		requests := []*http.Request{
+			newRequest("GET", "text/plain", ""),
+			newRequest("GET", "text/plain", ""),
+			newRequest("GET", "application/json", ""),
+			newRequest("POST", "text/plain", ""),
+			newRequest("POST", "text/plain", ""),
+			newRequest("GET", "text/plain", "another"),
+		}
+		responses, err := ProcessBatch(requests, DefaultTimeout, BatchOptions{})
+		if err != nil {
+			t.Fatalf("\t\tShould receive a response for each request, but received %s %v", err, cross)
+		}
+		mu.Lock()
+		sent := calls
+		mu.Unlock()
+		if sent == 4 {
+			t.Log("\t\tShould send each distinct request once", tick)
+		} else {
+			t.Errorf("\t\tShould send each distinct request once, but sent %d requests %v", sent, cross)
+		}
+		bodies := make([]string, len(responses))
+		for i, response := range responses {
+			bodies[i] = body(response)
+		}
+		if bodies[1] == bodies[0] && bodies[5] == bodies[0] && responses[1].Deduplicated && responses[5].Deduplicated &&
+			responses[1].Sequence == 1 && responses[1].Header.Get("Vary") == "Accept" {
+			t.Log("\t\tShould receive a copy of the response for each identical request", tick)
+		} else {
+			t.Errorf("\t\tShould receive a copy of the response for each identical request, but received %q %v", bodies, cross)
+		}
+		if bodies[2] != bodies[0] && bodies[3] != bodies[4] && !responses[0].Deduplicated && !responses[2].Deduplicated && !responses[4].Deduplicated {
+			t.Log("\t\tShould send requests with different headers or which are not idempotent", tick)
+		} else {
+			t.Errorf("\t\tShould send requests with different headers or which are not idempotent, but received %q %v", bodies, cross)
+		}
+	}
+
+	t.Log("We should send identical requests in a sequential batch")
+	{
+		requests := []*http.Request{newRequest("GET", "text/plain", ""), newRequest("GET", "text/plain", "")}
+		responses, _ := ProcessBatch(requests, DefaultTimeout, BatchOptions{Mode: ModeSequential})
+		if body(responses[0]) != body(responses[1]) && !responses[1].Deduplicated {
+			t.Log("\t\tShould send each request", tick)
+		} else {
+			t.Errorf("\t\tShould send each request, but received %+v %v", responses[1], cross)
+		}
+	}
+}
@@ -0,0 +1,437 @@
+package processors
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Caching, if not nil, caches the responses to requests as per RFC 9111 (https://www.rfc-editor.org/rfc/rfc9111)
+// so that requests can be served from the cache rather than sent (see Cache). It is nil (disabled) by default.
+var Caching *Cache
+
+// CacheHeader is the header used to mark whether the response to a request was served from the cache (`HIT`, `REVALIDATED`
+// or `STALE`) or not (`MISS`)
+const CacheHeader = "x-rrp-cache"
+
+// cacheableStatusCodes are the status codes of responses which can be cached (as long as they are explicitly fresh)
+var cacheableStatusCodes = map[int]bool{200: true, 203: true, 204: true, 300: true, 301: true, 308: true, 404: true, 405: true, 410: true, 414: true, 501: true}
+
+// conditionalHeaders are the headers which make a request conditional
+var conditionalHeaders = []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"}
+
+// Cache is an in-memory shared cache of the responses to `GET` requests as per RFC 9111.
+// Responses which are explicitly fresh (as per their `Cache-Control: s-maxage` or `max-age` directives or
+// `Expires` header) are served from the cache until they become stale. Once stale (or if they must always be
+// validated with the origin e.g. `Cache-Control: no-cache`) responses with a validator (an `ETag` or `Last-Modified`
+// header) are revalidated with a conditional request so that the body does not need to be sent again if it has not
+// been modified. Stale responses can also be served while they are revalidated in the background or if the origin fails
+// (see StaleWhileRevalidate and StaleIfError). Responses are stored for each variant of a request (as per their `Vary` header). Once the cache is
+// full the least recently used responses are evicted to make room.
+type Cache struct {
+	// StaleWhileRevalidate and StaleIfError configure how long stale responses can be served (as per RFC 5861) for
+	// each host when a response has no `Cache-Control: stale-while-revalidate` or `stale-if-error` directive.
+	// Hosts can include a port, start with a `.` to match any subdomain or be `*` to provide a default for any other hosts
+	// (see ParseStaleDefaults). A stale response is served while it is revalidated in the background or in place of
+	// the response to a request which fails (it can not be sent or the origin responds with a 500, 502, 503 or 504).
+	StaleWhileRevalidate map[string]time.Duration
+	StaleIfError         map[string]time.Duration
+
+	maxBytes int64
+	// (the store is safe for concurrent use, mu only guards refreshing)
+	store cacheStore
+
+	mu sync.Mutex
+	// refreshing holds the variants of the stale entries being revalidated in the background (see cacheEntry.variant)
+	refreshing map[string]bool
+}
+
+// cacheEntry is a response stored in the cache
+type cacheEntry struct {
+	url        string
+	host       string
+	varyValues map[string]string
+	status     string
+	statusCode int
+	proto      string
+	header     http.Header
+	body       []byte
+	// requestTime and responseTime are when the request was sent and the response received (for calculating its age)
+	requestTime  time.Time
+	responseTime time.Time
+	freshness    time.Duration
+	// staleWhileRevalidate and staleIfError are how long the response can be served once stale (see staleLifetimes)
+	// or -1 if the defaults for its host apply
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+	size                 int64
+	// bodyHash identifies the body of the response when it is stored on disk (see diskStore)
+	bodyHash string
+}
+
+// NewCache creates a Cache which stores responses in memory up to a total of maxBytes bytes (including their headers)
+func NewCache(maxBytes int64) *Cache {
+	return newCache(newMemoryStore(maxBytes), maxBytes)
+}
+
+func newCache(store cacheStore, maxBytes int64) *Cache {
+	return &Cache{
+		maxBytes:   maxBytes,
+		store:      store,
+		refreshing: make(map[string]bool),
+	}
+}
+
+// Close releases any resources held by the cache (e.g. the files of a disk cache)
+func (c *Cache) Close() error {
+	return c.store.close()
+}
+
+// parseCacheControl parses the directives of the `Cache-Control` headers e.g. `max-age=60, no-cache="Set-Cookie"`
+// (directives are lower case and any values are unquoted)
+func parseCacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				directives[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// seconds parses the value of a directive given in seconds (e.g. `max-age`) as per RFC 9111 section 1.2.2
+func seconds(value string) (time.Duration, bool) {
+	s, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || s < 0 {
+		return 0, false
+	}
+	return time.Duration(s) * time.Second, true
+}
+
+// cacheKey is the key used to store the responses to a request (the responses to any variants are stored together)
+// i.e. its URL along with its Host header if that differs from the host of the URL
+func cacheKey(request *http.Request) string {
+	if request.Host != "" && request.Host != request.URL.Host {
+		return request.URL.String() + " Host: " + request.Host
+	}
+	return request.URL.String()
+}
+
+// usable checks whether a response to the request can be served from the cache i.e. it is a `GET` request without
+// a body which does not ask for the response to be validated with the origin. Conditional requests (as sent by the
+// client) are not served from the cache so that they are passed through to the origin as they are.
+func (c *Cache) usable(request *http.Request) bool {
+	if (request.Method != "" && request.Method != http.MethodGet) || (request.Body != nil && request.Body != http.NoBody) {
+		return false
+	}
+	for _, h := range conditionalHeaders {
+		if request.Header.Get(h) != "" {
+			return false
+		}
+	}
+	directives := parseCacheControl(request.Header)
+	if _, ok := directives["no-store"]; ok {
+		return false
+	}
+	if _, ok := directives["no-cache"]; ok {
+		return false
+	}
+	if maxAge, ok := directives["max-age"]; ok && maxAge == "0" {
+		return false
+	}
+	if len(request.Header.Values("Cache-Control")) == 0 && strings.Contains(strings.ToLower(request.Header.Get("Pragma")), "no-cache") {
+		return false
+	}
+	return true
+}
+
+// freshnessLifetime works out how long a response (received at responseTime) is fresh for as per RFC 9111 section 4.2.1
+// for a shared cache (as only responses which are explicitly fresh are stored, heuristic freshness is not used)
+func freshnessLifetime(header http.Header, directives map[string]string, responseTime time.Time) (time.Duration, bool) {
+	if sMaxAge, ok := directives["s-maxage"]; ok {
+		return seconds(sMaxAge)
+	}
+	if maxAge, ok := directives["max-age"]; ok {
+		return seconds(maxAge)
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		e, err := http.ParseTime(expires)
+		if err != nil {
+			// (an invalid Expires header e.g. `0` means the response is already stale)
+			return 0, true
+		}
+		// (without a Date header the time the response was received is used)
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = responseTime
+		}
+		return e.Sub(date), true
+	}
+	return 0, false
+}
+
+// responseFreshness returns how long a response is fresh for, zero if it must be validated with the origin before
+// it is used (e.g. `Cache-Control: no-cache`) or it is not explicitly fresh
+func responseFreshness(header http.Header, directives map[string]string, responseTime time.Time) time.Duration {
+	freshness, ok := freshnessLifetime(header, directives, responseTime)
+	if _, noCache := directives["no-cache"]; noCache || !ok || freshness < 0 {
+		return 0
+	}
+	return freshness
+}
+
+// newCacheEntry creates the entry for storing the response to a request, returning nil if it can not be stored
+// as per RFC 9111 section 3 (along with it being explicitly fresh or having a validator and not too large for the cache)
+func (c *Cache) newCacheEntry(request *http.Request, response BatchedResponse) *cacheEntry {
+	if (request.Method != "" && request.Method != http.MethodGet) || response.Header == nil || !cacheableStatusCodes[response.StatusCode] {
+		return nil
+	}
+	header := *response.Header
+	// (error responses created by RRP are never stored)
+	if header.Get(ErrorCodeHeader) != "" {
+		return nil
+	}
+	if _, ok := parseCacheControl(request.Header)["no-store"]; ok {
+		return nil
+	}
+	directives := parseCacheControl(header)
+	for _, d := range []string{"no-store", "private"} {
+		if _, ok := directives[d]; ok {
+			return nil
+		}
+	}
+	// a response to a request with an `Authorization` header is only stored if it is explicitly allowed (section 3.5)
+	if request.Header.Get("Authorization") != "" {
+		_, public := directives["public"]
+		_, sMaxAge := directives["s-maxage"]
+		_, mustRevalidate := directives["must-revalidate"]
+		if !public && !sMaxAge && !mustRevalidate {
+			return nil
+		}
+	}
+	freshness := responseFreshness(header, directives, response.Started.Add(response.ProcessingDuration))
+	staleWhileRevalidate, staleIfError := staleLifetimes(directives)
+	if freshness == 0 && header.Get("ETag") == "" && header.Get("Last-Modified") == "" &&
+		staleLifetime(staleWhileRevalidate, c.StaleWhileRevalidate, request.URL.Host) == 0 && staleLifetime(staleIfError, c.StaleIfError, request.URL.Host) == 0 {
+		return nil
+	}
+	varyValues := make(map[string]string)
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return nil
+			}
+			if name != "" {
+				varyValues[name] = strings.Join(request.Header.Values(name), ", ")
+			}
+		}
+	}
+	// (responses always vary by Accept-Encoding, whether the origin says so or not, as the body is only decompressed
+	// for requests without an Accept-Encoding header e.g. unless the request asks to keep the encoding)
+	varyValues["Accept-Encoding"] = strings.Join(request.Header.Values("Accept-Encoding"), ", ")
+	var body []byte
+	if response.Body != nil {
+		body = make([]byte, response.Body.Size())
+		response.Body.ReadAt(body, 0)
+	}
+	entry := &cacheEntry{
+		url:          cacheKey(request),
+		host:         request.URL.Host,
+		varyValues:   varyValues,
+		status:       response.Status,
+		statusCode:   response.StatusCode,
+		proto:        response.Proto,
+		header:       header.Clone(),
+		body:         body,
+		requestTime:  response.Started,
+		responseTime: response.Started.Add(response.ProcessingDuration),
+		freshness:    freshness,
+
+		staleWhileRevalidate: staleWhileRevalidate,
+		staleIfError:         staleIfError,
+	}
+	entry.size = entry.computeSize()
+	if entry.size > c.maxBytes {
+		return nil
+	}
+	return entry
+}
+
+// computeSize works out the size of a stored response (including its headers)
+func (e *cacheEntry) computeSize() int64 {
+	size := int64(len(e.body) + len(e.url))
+	for name, values := range e.header {
+		size += int64(len(name))
+		for _, v := range values {
+			size += int64(len(v))
+		}
+	}
+	return size
+}
+
+// age works out the current age of a stored response as per RFC 9111 section 4.2.3
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	ageValue, _ := seconds(e.header.Get("Age"))
+	apparentAge := time.Duration(0)
+	if date, err := http.ParseTime(e.header.Get("Date")); err == nil && e.responseTime.After(date) {
+		apparentAge = e.responseTime.Sub(date)
+	}
+	correctedAgeValue := ageValue + e.responseTime.Sub(e.requestTime)
+	correctedInitialAge := apparentAge
+	if correctedAgeValue > correctedInitialAge {
+		correctedInitialAge = correctedAgeValue
+	}
+	return correctedInitialAge + now.Sub(e.responseTime)
+}
+
+// variant identifies the variant of a request the response is stored for
+func (e *cacheEntry) variant() string {
+	names := make([]string, 0, len(e.varyValues))
+	for name := range e.varyValues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var variant strings.Builder
+	variant.WriteString(e.url + "\n")
+	for _, name := range names {
+		variant.WriteString(name + ": " + e.varyValues[name] + "\n")
+	}
+	return variant.String()
+}
+
+// matches checks whether a stored response can be used for a request as per its `Vary` header (RFC 9111 section 4.1)
+func (e *cacheEntry) matches(request *http.Request) bool {
+	for name, value := range e.varyValues {
+		if strings.Join(request.Header.Values(name), ", ") != value {
+			return false
+		}
+	}
+	return true
+}
+
+// response returns a stored response for a request including an `Age` header and a `x-rrp-cache` header
+// marking how it was served from the cache (`HIT`, `REVALIDATED` or `STALE`)
+func (e *cacheEntry) response(sequence int, started time.Time, marker string) BatchedResponse {
+	header := e.header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(e.age(time.Now())/time.Second), 10))
+	header.Set(CacheHeader, marker)
+	var body *bytes.Reader
+	if e.body != nil {
+		body = bytes.NewReader(e.body)
+	}
+	return BatchedResponse{
+		Sequence:           sequence,
+		Status:             e.status,
+		StatusCode:         e.statusCode,
+		Proto:              e.proto,
+		Header:             &header,
+		Body:               body,
+		ProcessingDuration: time.Since(started),
+		Started:            started,
+	}
+}
+
+// lookup returns the response stored for a request (if any) whether it is fresh or not
+// (stored responses are never modified so can be used even once they have been replaced or evicted)
+func (c *Cache) lookup(request *http.Request) *cacheEntry {
+	if !c.usable(request) {
+		return nil
+	}
+	for _, entry := range c.store.variants(cacheKey(request)) {
+		if entry.matches(request) {
+			if loaded, ok := c.store.load(entry); ok {
+				return loaded
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// get returns the response stored for a request (see lookup) if it is still fresh.
+// The response includes an `Age` header and is marked as served from the cache with a `x-rrp-cache: HIT` header.
+func (c *Cache) get(r batchedRequest, entry *cacheEntry) (BatchedResponse, bool) {
+	started := time.Now()
+	if entry == nil || entry.age(started) >= entry.freshness {
+		return BatchedResponse{}, false
+	}
+	return entry.response(r.Sequence, started, "HIT"), true
+}
+
+// conditional returns the conditional request to send in place of a request to revalidate a stored response, or nil
+// if it has no validator i.e. neither an `ETag` nor `Last-Modified` header (the request itself is left as it is)
+func (e *cacheEntry) conditional(request *http.Request) *http.Request {
+	etag, lastModified := e.header.Get("ETag"), e.header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return nil
+	}
+	conditional := request.Clone(request.Context())
+	if etag != "" {
+		conditional.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		conditional.Header.Set("If-Modified-Since", lastModified)
+	}
+	return conditional
+}
+
+// refresh updates a stored response with the `304 Not Modified` response to a conditional request as per RFC 9111
+// section 4.3.4 (its headers replace those stored) returning the stored response, which is marked as served
+// from the cache with a `x-rrp-cache: REVALIDATED` header.
+func (c *Cache) refresh(request *http.Request, entry *cacheEntry, notModified BatchedResponse) BatchedResponse {
+	refreshed := *entry
+	refreshed.header = entry.header.Clone()
+	for name, values := range *notModified.Header {
+		switch name {
+		case "Content-Length", "Transfer-Encoding", "Content-Encoding", ServerTimingHeader:
+			continue
+		}
+		refreshed.header[name] = values
+	}
+	refreshed.requestTime = notModified.Started
+	refreshed.responseTime = notModified.Started.Add(notModified.ProcessingDuration)
+	directives := parseCacheControl(refreshed.header)
+	refreshed.freshness = responseFreshness(refreshed.header, directives, refreshed.responseTime)
+	refreshed.staleWhileRevalidate, refreshed.staleIfError = staleLifetimes(directives)
+	refreshed.size = refreshed.computeSize()
+	if refreshed.size <= c.maxBytes {
+		c.insert(request, &refreshed)
+	}
+	response := refreshed.response(notModified.Sequence, notModified.Started, "REVALIDATED")
+	response.ProcessingDuration = notModified.ProcessingDuration
+	return response
+}
+
+// put stores the response to a request if it can be stored (see newCacheEntry), replacing any response stored for
+// the same variant of the request. A successful response to an unsafe request (e.g. `POST`) invalidates any responses
+// stored for its URL as per RFC 9111 section 4.4.
+func (c *Cache) put(request *http.Request, response BatchedResponse) {
+	key := cacheKey(request)
+	switch request.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, "TRACE":
+	default:
+		if response.StatusCode >= 200 && response.StatusCode < 400 {
+			c.store.removeAll(key)
+		}
+		return
+	}
+	if entry := c.newCacheEntry(request, response); entry != nil {
+		c.insert(request, entry)
+	}
+}
+
+// insert adds a response to the cache replacing any response stored for the same variant of the request
+// (the least recently used responses are evicted to make room)
+func (c *Cache) insert(request *http.Request, entry *cacheEntry) {
+	c.store.add(entry, func(stored *cacheEntry) bool {
+		return stored.matches(request)
+	})
+}
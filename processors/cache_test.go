@@ -0,0 +1,220 @@
+package processors
+
+import (
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCaching(t *testing.T) {
+	var calls int64
+	lastModified := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := atomic.AddInt64(&calls, 1)
+		switch r.URL.Path {
+		case "/max-age":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/s-maxage":
+			w.Header().Set("Cache-Control", "max-age=60, s-maxage=0")
+		case "/no-store":
+			w.Header().Set("Cache-Control", "max-age=60, no-store")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/expires":
+			w.Header().Set("Expires", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+		case "/expires-without-date":
+			w.Header()["Date"] = nil
+			w.Header().Set("Expires", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+		case "/expired":
+			w.Header().Set("Expires", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat))
+		case "/age":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Age", r.URL.Query().Get("age"))
+		case "/gzip":
+			// (the response is compressed if the request accepts it, without a Vary header)
+			w.Header().Set("Cache-Control", "max-age=60")
+			if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+				w.Header().Set("Content-Encoding", "gzip")
+				zw := gzip.NewWriter(w)
+				zw.Write([]byte(r.URL.Path + " " + strconv.FormatInt(call, 10)))
+				zw.Close()
+				return
+			}
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept")
+		case "/etag":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.Header().Set("Cache-Control", "max-age=60")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/last-modified":
+			w.Header().Set("Cache-Control", "max-age=0")
+			w.Header().Set("Last-Modified", lastModified)
+			if r.Header.Get("If-Modified-Since") == lastModified {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.Write([]byte(r.URL.Path + " " + strconv.FormatInt(call, 10)))
+	}))
+	defer upstream.Close()
+
+	Caching = NewCache(1 << 20)
+	defer func() { Caching = nil }()
+
+	get := func(path string, header ...string) *BatchedResponse {
+		request, _ := http.NewRequest("GET", upstream.URL+path, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			request.Header.Set(header[i], header[i+1])
+		}
+		responses, _ := ProcessBatch([]*http.Request{request}, DefaultTimeout, BatchOptions{})
+		return responses[0]
+	}
+	// cached sends a request twice checking whether the second response was served from the cache
+	cached := func(path string, header ...string) bool {
+		first := get(path, header...)
+		second := get(path, header...)
+		return first.Header.Get(CacheHeader) == "MISS" && second.Header.Get(CacheHeader) == "HIT" && body(first) == body(second)
+	}
+
+	t.Log("We should be able to serve fresh responses from the cache")
+	{
+		before := atomic.LoadInt64(&calls)
+		first, second := get("/max-age"), get("/max-age")
+		if first.Header.Get(CacheHeader) == "MISS" && second.Header.Get(CacheHeader) == "HIT" && second.Header.Get("Age") == "0" &&
+			body(first) == body(second) && atomic.LoadInt64(&calls) == before+1 {
+			t.Log("\t\tShould serve a response with a max-age from the cache with an Age header", tick)
+		} else {
+			t.Errorf("\t\tShould serve a response with a max-age from the cache with an Age header, but received %v %v", second.Header, cross)
+		}
+		if cached("/expires") {
+			t.Log("\t\tShould serve a response with an Expires header from the cache", tick)
+		} else {
+			t.Errorf("\t\tShould serve a response with an Expires header from the cache %v", cross)
+		}
+		if cached("/expires-without-date") {
+			t.Log("\t\tShould serve a response with an Expires header but no Date header from the cache", tick)
+		} else {
+			t.Errorf("\t\tShould serve a response with an Expires header but no Date header from the cache %v", cross)
+		}
+		if get("/age?age=30"); get("/age?age=30").Header.Get("Age") == "30" {
+			t.Log("\t\tShould include the age of the response when received in its Age header", tick)
+		} else {
+			t.Errorf("\t\tShould include the age of the response when received in its Age header %v", cross)
+		}
+	}
+
+	t.Log("We should not serve responses from the cache which can not be stored or are stale")
+	{
+		for _, path := range []string{"/s-maxage", "/no-store", "/private", "/expired", "/age?age=70", "/"} {
+			if !cached(path) {
+				t.Logf("\t\tShould not serve %s from the cache %v", path, tick)
+			} else {
+				t.Errorf("\t\tShould not serve %s from the cache %v", path, cross)
+			}
+		}
+		if !cached("/max-age?no-cache", "Cache-Control", "no-cache") {
+			t.Log("\t\tShould not serve a response from the cache for a request with `Cache-Control: no-cache`", tick)
+		} else {
+			t.Errorf("\t\tShould not serve a response from the cache for a request with `Cache-Control: no-cache` %v", cross)
+		}
+		if !cached("/max-age?authorization", "Authorization", "Bearer token") {
+			t.Log("\t\tShould not serve a response from the cache for a request with an Authorization header", tick)
+		} else {
+			t.Errorf("\t\tShould not serve a response from the cache for a request with an Authorization header %v", cross)
+		}
+	}
+
+	t.Log("We should be able to revalidate stale responses in the cache with the origin")
+	{
+		first, second, third := get("/etag"), get("/etag"), get("/etag")
+		original := body(first)
+		if first.Header.Get(CacheHeader) == "MISS" && second.Header.Get(CacheHeader) == "REVALIDATED" && second.StatusCode == http.StatusOK &&
+			body(second) == original && third.Header.Get(CacheHeader) == "HIT" && body(third) == original {
+			t.Log("\t\tShould serve the response from the cache once the origin responds to If-None-Match with 304 (Not Modified) and refresh it", tick)
+		} else {
+			t.Errorf("\t\tShould serve the response from the cache once the origin responds to If-None-Match with 304 (Not Modified) and refresh it, but received %v %v", second.Header, cross)
+		}
+		first, second = get("/last-modified"), get("/last-modified")
+		if first.Header.Get(CacheHeader) == "MISS" && second.Header.Get(CacheHeader) == "REVALIDATED" && body(first) == body(second) {
+			t.Log("\t\tShould serve the response from the cache once the origin responds to If-Modified-Since with 304 (Not Modified)", tick)
+		} else {
+			t.Errorf("\t\tShould serve the response from the cache once the origin responds to If-Modified-Since with 304 (Not Modified), but received %v %v", second.Header, cross)
+		}
+		response := get("/etag", "If-None-Match", `"v1"`)
+		if response.StatusCode == http.StatusNotModified && response.Header.Get(CacheHeader) == "" {
+			t.Log("\t\tShould pass conditional requests sent by the client through to the origin", tick)
+		} else {
+			t.Errorf("\t\tShould pass conditional requests sent by the client through to the origin, but received %d %v %v", response.StatusCode, response.Header, cross)
+		}
+	}
+
+	t.Log("We should be able to serve a response from the cache for each variant of a request")
+	{
+		get("/vary", "Accept", "text/plain")
+		other := get("/vary", "Accept", "application/json")
+		same := get("/vary", "Accept", "text/plain")
+		if other.Header.Get(CacheHeader) == "MISS" && same.Header.Get(CacheHeader) == "HIT" {
+			t.Log("\t\tShould only serve the response for the same variant", tick)
+		} else {
+			t.Errorf("\t\tShould only serve the response for the same variant, but received %s and %s %v", other.Header.Get(CacheHeader), same.Header.Get(CacheHeader), cross)
+		}
+		hosted := func(host string) *BatchedResponse {
+			request, _ := http.NewRequest("GET", upstream.URL+"/max-age?hosted", nil)
+			request.Host = host
+			responses, _ := ProcessBatch([]*http.Request{request}, DefaultTimeout, BatchOptions{})
+			return responses[0]
+		}
+		hosted("api.example.com")
+		if other, same := hosted("www.example.com"), hosted("api.example.com"); other.Header.Get(CacheHeader) == "MISS" && same.Header.Get(CacheHeader) == "HIT" {
+			t.Log("\t\tShould only serve the response for the same Host header", tick)
+		} else {
+			t.Errorf("\t\tShould only serve the response for the same Host header, but received %s and %s %v", other.Header.Get(CacheHeader), same.Header.Get(CacheHeader), cross)
+		}
+		request, _ := http.NewRequest("GET", upstream.URL+"/gzip", nil)
+		ProcessBatch([]*http.Request{request}, DefaultTimeout, BatchOptions{KeepEncoding: true})
+		if response := get("/gzip"); response.Header.Get(CacheHeader) == "MISS" && response.Header.Get("Content-Encoding") == "" && strings.HasPrefix(body(response), "/gzip ") {
+			t.Log("\t\tShould not serve a compressed response kept encoded to a request which did not ask for it", tick)
+		} else {
+			t.Errorf("\t\tShould not serve a compressed response kept encoded to a request which did not ask for it, but received %v %v", response.Header, cross)
+		}
+	}
+
+	t.Log("We should invalidate responses in the cache for a successful unsafe request")
+	{
+		get("/max-age?invalidate")
+		request, _ := http.NewRequest("POST", upstream.URL+"/max-age?invalidate", nil)
+		ProcessBatch([]*http.Request{request}, DefaultTimeout, BatchOptions{})
+		if response := get("/max-age?invalidate"); response.Header.Get(CacheHeader) == "MISS" {
+			t.Log("\t\tShould not serve the response from the cache", tick)
+		} else {
+			t.Errorf("\t\tShould not serve the response from the cache, but received %v %v", response.Header, cross)
+		}
+	}
+
+	t.Log("We should evict the least recently used responses once the cache is full")
+	{
+		Caching = NewCache(1 << 20)
+		get("/max-age?lru=1")
+		// (the cache only has room for 2 responses)
+		store := Caching.store.(*memoryStore)
+		store.maxBytes = store.used*2 + store.used/2
+		get("/max-age?lru=2")
+		get("/max-age?lru=1")
+		get("/max-age?lru=3")
+		if get("/max-age?lru=1").Header.Get(CacheHeader) == "HIT" && get("/max-age?lru=2").Header.Get(CacheHeader) == "MISS" {
+			t.Log("\t\tShould evict the least recently used response", tick)
+		} else {
+			t.Errorf("\t\tShould evict the least recently used response %v", cross)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package processors
+
+import (
+	"container/list"
+	"sync"
+)
+
+// cacheStore stores the responses held in a Cache, evicting the least recently used responses once it is full.
+// Its methods are safe for concurrent use.
+type cacheStore interface {
+	// variants returns the responses stored for a URL (one for each variant) which may not include their bodies
+	variants(url string) []*cacheEntry
+	// load returns a response stored (as returned by variants) including its body, marking it as the most recently
+	// used. If it can no longer be loaded it is removed from the store.
+	load(entry *cacheEntry) (*cacheEntry, bool)
+	// add stores a response, replacing the response stored for the same URL which replaces matches (if any)
+	// and evicting the least recently used responses to make room
+	add(entry *cacheEntry, replaces func(stored *cacheEntry) bool)
+	// removeAll removes the responses stored for a URL
+	removeAll(url string)
+	// close releases any resources held by the store
+	close() error
+}
+
+// memoryStore is a cacheStore which holds the responses in memory
+type memoryStore struct {
+	maxBytes int64
+
+	mu   sync.Mutex
+	used int64
+	// lru holds the entries in order of use (most recently used first)
+	// and urls holds the entries for each URL (one for each variant)
+	lru      *list.List
+	elements map[*cacheEntry]*list.Element
+	urls     map[string][]*cacheEntry
+	// removed, if not nil, is called (with mu held) for each response removed from the store (including those evicted)
+	removed func(entry *cacheEntry)
+}
+
+func newMemoryStore(maxBytes int64) *memoryStore {
+	return &memoryStore{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		elements: make(map[*cacheEntry]*list.Element),
+		urls:     make(map[string][]*cacheEntry),
+	}
+}
+
+func (s *memoryStore) variants(url string) []*cacheEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*cacheEntry(nil), s.urls[url]...)
+}
+
+func (s *memoryStore) load(entry *cacheEntry) (*cacheEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	element, ok := s.elements[entry]
+	if !ok {
+		return nil, false
+	}
+	s.lru.MoveToFront(element)
+	return entry, true
+}
+
+func (s *memoryStore) add(entry *cacheEntry, replaces func(stored *cacheEntry) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if replaces != nil {
+		for _, stored := range s.urls[entry.url] {
+			if replaces(stored) {
+				s.remove(stored)
+				break
+			}
+		}
+	}
+	for s.used+entry.size > s.maxBytes && s.lru.Len() > 0 {
+		s.remove(s.lru.Back().Value.(*cacheEntry))
+	}
+	s.elements[entry] = s.lru.PushFront(entry)
+	s.urls[entry.url] = append(s.urls[entry.url], entry)
+	s.used += entry.size
+}
+
+func (s *memoryStore) removeAll(url string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.urls[url]) > 0 {
+		s.remove(s.urls[url][0])
+	}
+}
+
+// discard removes a stored response
+func (s *memoryStore) discard(entry *cacheEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(entry)
+}
+
+// remove removes a stored response (s.mu must be held)
+func (s *memoryStore) remove(entry *cacheEntry) {
+	element, ok := s.elements[entry]
+	if !ok {
+		return
+	}
+	s.lru.Remove(element)
+	delete(s.elements, entry)
+	s.used -= entry.size
+	variants := s.urls[entry.url]
+	for i, e := range variants {
+		if e == entry {
+			variants = append(variants[:i], variants[i+1:]...)
+			break
+		}
+	}
+	if len(variants) == 0 {
+		delete(s.urls, entry.url)
+	} else {
+		s.urls[entry.url] = variants
+	}
+	if s.removed != nil {
+		s.removed(entry)
+	}
+}
+
+// oldest returns the responses stored in order of use (least recently used first)
+func (s *memoryStore) oldest() []*cacheEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make([]*cacheEntry, 0, s.lru.Len())
+	for element := s.lru.Back(); element != nil; element = element.Prev() {
+		entries = append(entries, element.Value.(*cacheEntry))
+	}
+	return entries
+}
+
+func (s *memoryStore) close() error {
+	return nil
+}
@@ -12,6 +12,8 @@ var (
 	// DefaultClient is an instance of the custom http.Client created with with the DefaultTimeout
 	// (The returned client has a more leniant redirect policy always URL encoding/escaping the location prior to redirect)
 	DefaultClient *http.Client
+	// MaxResponseSize is the maximum size in bytes of the body of an individual response buffered for a batch, zero (the default) means no limit
+	MaxResponseSize int64
 )
 
 func init() {
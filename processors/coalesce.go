@@ -0,0 +1,205 @@
+package processors
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Coalescing, if not nil, coalesces identical requests sent concurrently by different batches (see Coalescer).
+// It is nil (disabled) by default.
+var Coalescing *Coalescer
+
+// CoalesceRules configures which requests are eligible to be coalesced
+type CoalesceRules struct {
+	// Methods are the methods of requests which can be coalesced, if empty `GET` and `HEAD` requests are coalesced
+	Methods []string
+	// Hosts are the hosts of requests which can be coalesced (with or without a port), if empty any host can be.
+	// A host starting with `.` matches any subdomain e.g. `.example.com`
+	Hosts []string
+	// Headers are the request headers a request can have and still be coalesced. The values of the headers are
+	// compared so only requests with the same values are coalesced. Requests with any other headers are never coalesced
+	// (apart from headers which only identify a request e.g. `x-request-id`)
+	Headers []string
+}
+
+// CoalesceStats are the metrics of a Coalescer
+type CoalesceStats struct {
+	// Eligible is the number of requests which were eligible to be coalesced
+	Eligible int64 `json:"eligible"`
+	// Sent is the number of eligible requests which were sent
+	Sent int64 `json:"sent"`
+	// Coalesced is the number of eligible requests which shared the response to a request already in flight (so were not sent)
+	Coalesced int64 `json:"coalesced"`
+	// InFlight is the number of requests currently in flight
+	InFlight int64 `json:"inFlight"`
+}
+
+// Coalescer shares a single in-flight upstream call among identical requests sent concurrently by different batches
+// i.e. whilst a request is in flight any identical requests wait for and get a copy of its response rather than
+// being sent. As the response is shared, only requests which are eligible as per its rules are coalesced.
+type Coalescer struct {
+	rules   CoalesceRules
+	methods map[string]bool
+	headers map[string]bool
+
+	mu       sync.Mutex
+	inFlight map[string]*inFlightCall
+
+	eligible  int64
+	sent      int64
+	coalesced int64
+}
+
+// inFlightCall is a request which is in flight, done is closed once its response is available
+type inFlightCall struct {
+	done     chan struct{}
+	response BatchedResponse
+}
+
+// NewCoalescer creates a Coalescer with the specified eligibility rules
+func NewCoalescer(rules CoalesceRules) *Coalescer {
+	c := &Coalescer{
+		rules:    rules,
+		methods:  make(map[string]bool),
+		headers:  make(map[string]bool),
+		inFlight: make(map[string]*inFlightCall),
+	}
+	if len(rules.Methods) == 0 {
+		rules.Methods = []string{http.MethodGet, http.MethodHead}
+	}
+	for _, m := range rules.Methods {
+		c.methods[strings.ToUpper(m)] = true
+	}
+	for _, h := range rules.Headers {
+		c.headers[http.CanonicalHeaderKey(h)] = true
+	}
+	return c
+}
+
+// Stats returns the metrics of the Coalescer
+func (c *Coalescer) Stats() CoalesceStats {
+	c.mu.Lock()
+	inFlight := int64(len(c.inFlight))
+	c.mu.Unlock()
+	return CoalesceStats{
+		Eligible:  atomic.LoadInt64(&c.eligible),
+		Sent:      atomic.LoadInt64(&c.sent),
+		Coalesced: atomic.LoadInt64(&c.coalesced),
+		InFlight:  inFlight,
+	}
+}
+
+// key returns the key identifying identical requests, or an empty string if the request is not eligible to be coalesced.
+// As the response shared is subject to the timeout of the request sent, only requests with the same timeout are identical
+// (as for dedupKey).
+func (c *Coalescer) key(request *http.Request, timeout time.Duration) string {
+	method := request.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	if !c.methods[method] || (request.Body != nil && request.Body != http.NoBody) || !c.eligibleHost(request.URL.Host) {
+		return ""
+	}
+	names := make([]string, 0, len(request.Header))
+	for name := range request.Header {
+		name = http.CanonicalHeaderKey(name)
+		if dedupIgnoredHeaders[name] {
+			continue
+		}
+		if !c.headers[name] {
+			return ""
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var key strings.Builder
+	key.WriteString(method + " " + request.URL.String() + "\n")
+	for _, name := range names {
+		key.WriteString(name + ": " + strings.Join(request.Header.Values(name), ", ") + "\n")
+	}
+	key.WriteString("timeout: " + timeout.String() + "\n")
+	return key.String()
+}
+
+func (c *Coalescer) eligibleHost(host string) bool {
+	if len(c.rules.Hosts) == 0 {
+		return true
+	}
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, h := range c.rules.Hosts {
+		h = strings.ToLower(h)
+		switch {
+		case h == "*", h == strings.ToLower(host), h == strings.ToLower(hostname):
+			return true
+		case strings.HasPrefix(h, ".") && strings.HasSuffix(strings.ToLower(hostname), h):
+			return true
+		}
+	}
+	return false
+}
+
+// do sends an individual request using send unless an identical request is already in flight, in which case it waits
+// (for up to its timeout) for the response to that request and returns a copy of it. If the request in flight could
+// not be sent (its response is an error response created by RRP) the request is sent using send instead.
+func (c *Coalescer) do(r batchedRequest, timeout time.Duration, send func() BatchedResponse) BatchedResponse {
+	key := c.key(r.Request, timeout)
+	if key == "" {
+		return send()
+	}
+	atomic.AddInt64(&c.eligible, 1)
+	c.mu.Lock()
+	if call, ok := c.inFlight[key]; ok {
+		c.mu.Unlock()
+		atomic.AddInt64(&c.coalesced, 1)
+		return c.wait(r, call, timeout, send)
+	}
+	call := &inFlightCall{done: make(chan struct{})}
+	c.inFlight[key] = call
+	c.mu.Unlock()
+	atomic.AddInt64(&c.sent, 1)
+
+	// (the call is removed once it has completed so only requests sent whilst it is in flight share its response)
+	defer func() {
+		c.mu.Lock()
+		delete(c.inFlight, key)
+		c.mu.Unlock()
+		close(call.done)
+	}()
+	call.response = send()
+	return call.response
+}
+
+// wait waits for the response to a request in flight, returning a timeout error response if it takes too long
+func (c *Coalescer) wait(r batchedRequest, call *inFlightCall, timeout time.Duration, send func() BatchedResponse) BatchedResponse {
+	startedProcessing := time.Now()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-call.done:
+		// (an error e.g. the request in flight being cancelled along with its batch is not shared)
+		if call.response.Header != nil && call.response.Header.Get(ErrorCodeHeader) != "" {
+			atomic.AddInt64(&c.sent, 1)
+			return send()
+		}
+		response := copyResponse(call.response)
+		response.Sequence = r.Sequence
+		return response
+	case <-timer.C:
+		err = context.DeadlineExceeded
+	case <-r.Request.Context().Done():
+		err = r.Request.Context().Err()
+	}
+	err = fmt.Errorf("awaiting response to identical request in flight: %w", err)
+	return transportErrorResponse(r.Sequence, r.Request.Proto, err, timeout, startedProcessing)
+}
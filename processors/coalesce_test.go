@@ -0,0 +1,131 @@
+package processors
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalescing(t *testing.T) {
+	var calls int64
+	received, release := make(chan struct{}, 3), make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := atomic.AddInt64(&calls, 1)
+		if r.URL.Path == "/hot" {
+			received <- struct{}{}
+			<-release
+		}
+		w.Write([]byte(r.URL.Path + " " + strconv.FormatInt(call, 10)))
+	}))
+	defer upstream.Close()
+	// (any requests still waiting are released if the test fails so that the upstream server can be closed)
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	Coalescing = NewCoalescer(CoalesceRules{Headers: []string{"Accept"}})
+	defer func() { Coalescing = nil }()
+
+	t.Log("We should be able to coalesce identical requests sent concurrently by different batches")
+	{
+		var wg sync.WaitGroup
+		responses := make([]*BatchedResponse, 3)
+		for i := range responses {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				request, _ := http.NewRequest("GET", upstream.URL+"/hot", nil)
+				request.Header.Set("Accept", "text/plain")
+				request.Header.Set("x-request-id", strconv.Itoa(i))
+				batch, _ := ProcessBatch([]*http.Request{request}, DefaultTimeout, BatchOptions{})
+				responses[i] = batch[0]
+			}(i)
+		}
+		// (the response is only sent once the request has been received and all the other requests are waiting for it)
+		waitForSignal(t, received, "send the request")
+		waitFor(t, func() bool { return Coalescing.Stats().Coalesced >= 2 }, "coalesce the requests waiting for the response")
+		close(release)
+		wg.Wait()
+
+		if atomic.LoadInt64(&calls) == 1 && body(responses[0]) == "/hot 1" && body(responses[1]) == "/hot 1" && body(responses[2]) == "/hot 1" {
+			t.Log("\t\tShould send the request once and share its response", tick)
+		} else {
+			t.Errorf("\t\tShould send the request once and share its response, but sent %d requests %v", atomic.LoadInt64(&calls), cross)
+		}
+		if stats := Coalescing.Stats(); stats == (CoalesceStats{Eligible: 3, Sent: 1, Coalesced: 2}) {
+			t.Log("\t\tShould count the requests coalesced", tick)
+		} else {
+			t.Errorf("\t\tShould count the requests coalesced, but received %+v %v", stats, cross)
+		}
+	}
+
+	t.Log("We should not share an error response with identical requests")
+	{
+		c := NewCoalescer(CoalesceRules{})
+		request, _ := http.NewRequest("GET", upstream.URL+"/error", nil)
+		started, failed := make(chan struct{}), make(chan struct{})
+		go c.do(batchedRequest{Request: request}, DefaultTimeout, func() BatchedResponse {
+			close(started)
+			<-failed
+			return *ErrorResponse(0, "", http.StatusGatewayTimeout, "timeout", context.DeadlineExceeded)
+		})
+		<-started
+		responses := make(chan BatchedResponse)
+		go func() {
+			responses <- c.do(batchedRequest{Sequence: 1, Request: request}, DefaultTimeout, func() BatchedResponse {
+				return BatchedResponse{Sequence: 1, Status: "200 OK", StatusCode: http.StatusOK}
+			})
+		}()
+		waitFor(t, func() bool { return c.Stats().Coalesced >= 1 }, "coalesce the request with the request in flight")
+		close(failed)
+		if response := <-responses; response.StatusCode == http.StatusOK {
+			t.Log("\t\tShould send the request instead once the request in flight fails", tick)
+		} else {
+			t.Errorf("\t\tShould send the request instead once the request in flight fails, but received %s %v", response.Status, cross)
+		}
+	}
+
+	t.Log("We should only coalesce eligible requests")
+	{
+		c := NewCoalescer(CoalesceRules{Methods: []string{"get"}, Hosts: []string{"api.example.com", ".example.org"}, Headers: []string{"accept"}})
+		newRequest := func(method string, url string, header string) *http.Request {
+			request, _ := http.NewRequest(method, url, nil)
+			if header != "" {
+				request.Header.Set(header, "value")
+			}
+			return request
+		}
+		for _, tc := range []struct {
+			request  *http.Request
+			eligible bool
+		}{
+			{newRequest("GET", "https://api.example.com/items", "Accept"), true},
+			{newRequest("GET", "https://api.example.com:8443/items", "x-request-id"), true},
+			{newRequest("GET", "https://www.example.org/items", ""), true},
+			{newRequest("HEAD", "https://api.example.com/items", ""), false},
+			{newRequest("GET", "https://www.example.com/items", ""), false},
+			{newRequest("GET", "https://api.example.com/items", "Authorization"), false},
+		} {
+			if (c.key(tc.request, DefaultTimeout) != "") == tc.eligible {
+				t.Logf("\t\tShould find %s %s with %v eligible %t %v", tc.request.Method, tc.request.URL, tc.request.Header, tc.eligible, tick)
+			} else {
+				t.Errorf("\t\tShould find %s %s with %v eligible %t %v", tc.request.Method, tc.request.URL, tc.request.Header, tc.eligible, cross)
+			}
+		}
+		request := newRequest("GET", "https://api.example.com/items", "")
+		if c.key(request, time.Second) != c.key(request, DefaultTimeout) {
+			t.Log("\t\tShould only coalesce requests with the same timeout", tick)
+		} else {
+			t.Errorf("\t\tShould only coalesce requests with the same timeout %v", cross)
+		}
+	}
+}
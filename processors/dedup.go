@@ -0,0 +1,90 @@
+package processors
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// dedupIgnoredHeaders are request headers which identify an individual request rather than what it asks for
+// so are ignored when comparing requests
+var dedupIgnoredHeaders = map[string]bool{"X-Request-Id": true, "Traceparent": true, "Tracestate": true, "X-Rrp-Timeout": true}
+
+// dedupKey returns a key identifying an individual request so that identical requests in a batch can be sent once.
+// Only requests with a safe (and so idempotent) method and no body are deduplicated. As the response to any of their
+// headers may vary (as per its `Vary` header), requests are only identical if they have the same method, URL and headers
+// (along with the same timeout). An empty key is returned for a request which can not be deduplicated.
+func dedupKey(request *http.Request, part PartOptions) string {
+	if request.Method != "" && request.Method != http.MethodGet && request.Method != http.MethodHead {
+		return ""
+	}
+	if request.Body != nil && request.Body != http.NoBody {
+		return ""
+	}
+	var key strings.Builder
+	key.WriteString(request.Method + " " + request.URL.String() + "\n")
+	key.WriteString("timeout: " + part.Timeout.String() + "\n")
+	names := make([]string, 0, len(request.Header))
+	for name := range request.Header {
+		if !dedupIgnoredHeaders[http.CanonicalHeaderKey(name)] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		key.WriteString(http.CanonicalHeaderKey(name) + ": " + strings.Join(request.Header[name], ", ") + "\n")
+	}
+	return key.String()
+}
+
+// findDuplicates returns, for each request in a batch, the sequence of an earlier identical request (see dedupKey)
+// whose response can be used for it rather than sending it, or -1 if the request should be sent.
+// Requests which depend on other requests or which are marked as AlwaysSend are always sent
+// (and those which are invalid or have a response already never are).
+// If dedup is false no requests are deduplicated.
+func findDuplicates(requests []*http.Request, parts []PartOptions, dependencies [][]int, invalid []error, dedup bool) []int {
+	duplicateOf := make([]int, len(requests))
+	first := make(map[string]int)
+	for i, request := range requests {
+		duplicateOf[i] = -1
+		if !dedup || parts[i].Response != nil || invalid[i] != nil || len(dependencies[i]) > 0 || parts[i].AlwaysSend {
+			continue
+		}
+		key := dedupKey(request, parts[i])
+		if key == "" {
+			continue
+		}
+		if d, ok := first[key]; ok {
+			duplicateOf[i] = d
+			continue
+		}
+		first[key] = i
+	}
+	return duplicateOf
+}
+
+// duplicateResponse waits for an earlier identical request to be processed and returns a copy of its response
+func (b *batchState) duplicateResponse(sequence int, duplicateOf int) BatchedResponse {
+	<-b.processed[duplicateOf]
+	response := copyResponse(b.results[duplicateOf])
+	response.Sequence = sequence
+	response.Deduplicated = true
+	return response
+}
+
+// copyResponse returns a copy of a response (with its own copy of the headers and body)
+// so that it can be returned for another request
+func copyResponse(response BatchedResponse) BatchedResponse {
+	if response.Header != nil {
+		header := response.Header.Clone()
+		response.Header = &header
+	}
+	if response.Body != nil {
+		// (ReadAt is used as it leaves the original body unread)
+		body := make([]byte, response.Body.Size())
+		response.Body.ReadAt(body, 0)
+		response.Body = bytes.NewReader(body)
+	}
+	return response
+}
@@ -0,0 +1,451 @@
+package processors
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// diskStore is a cacheStore which holds the responses on disk so they survive a restart. The bodies of the responses
+// are content-addressed i.e. stored in `objects/<sha256 of the body>` (so responses with the same body share it) and
+// the rest of each response is recorded in an index (which is also held in memory). The index is a journal of the
+// responses added and removed which is compacted when the store is opened and once it has grown too large.
+//
+// The store tolerates a crash: a body is written to a temporary file which is synced before being renamed into place
+// (and the rename synced) and only then added to the index, any incomplete (torn) record at the end of the index is
+// ignored and any bodies which are not in the index are deleted when the store is opened. Records appended to the
+// index are not synced, so on a power loss the responses stored (or removed) most recently may be lost, in which case
+// they are simply fetched again. As uses of responses are not recorded in the index the
+// least recently used order is only approximated on a warm start (by when the responses were added).
+//
+// Bodies are read, written and deleted, and the index is rewritten, without holding mu (which only guards the index
+// held in memory and appending records to the index) so that requests are not held up by the disk.
+type diskStore struct {
+	dir   string
+	index *memoryStore
+	// files serialises writing and deleting bodies so that a body is not deleted once a response being added shares it
+	files sync.Mutex
+
+	mu      sync.Mutex
+	ids     map[string]*cacheEntry
+	objects map[string]int
+	// journal is the index open for appending records and records is the number of records it holds
+	journal *os.File
+	records int
+	closed  bool
+	// pending holds the records appended while the index is being compacted (to append to the compacted index)
+	compacting bool
+	pending    [][]byte
+	// unused holds the bodies no longer referenced, which are deleted once mu is released (see unlock)
+	unused []string
+}
+
+// diskRecord is a record in the index of a diskStore, either adding or removing a response
+type diskRecord struct {
+	Add    *diskEntry `json:"add,omitempty"`
+	Remove string     `json:"remove,omitempty"`
+}
+
+// diskEntry is a response recorded in the index of a diskStore
+type diskEntry struct {
+	URL                  string            `json:"url"`
+	Host                 string            `json:"host"`
+	Vary                 map[string]string `json:"vary,omitempty"`
+	Status               string            `json:"status"`
+	StatusCode           int               `json:"statusCode"`
+	Proto                string            `json:"proto"`
+	Header               http.Header       `json:"header"`
+	Body                 string            `json:"body,omitempty"`
+	RequestTime          time.Time         `json:"requestTime"`
+	ResponseTime         time.Time         `json:"responseTime"`
+	Freshness            time.Duration     `json:"freshness"`
+	StaleWhileRevalidate time.Duration     `json:"staleWhileRevalidate"`
+	StaleIfError         time.Duration     `json:"staleIfError"`
+	Size                 int64             `json:"size"`
+}
+
+// NewDiskCache creates a Cache which stores responses in the directory dir up to a total of maxBytes bytes (including
+// their headers), creating the directory if it does not exist. Any responses already stored in the directory are
+// loaded so that they can be served straight away (only one Cache should use a directory at a time).
+func NewDiskCache(dir string, maxBytes int64) (*Cache, error) {
+	store, err := openDiskStore(dir, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	return newCache(store, maxBytes), nil
+}
+
+func openDiskStore(dir string, maxBytes int64) (*diskStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "objects"), 0o755); err != nil {
+		return nil, err
+	}
+	s := &diskStore{
+		dir:     dir,
+		index:   newMemoryStore(maxBytes),
+		ids:     make(map[string]*cacheEntry),
+		objects: make(map[string]int),
+	}
+	s.index.removed = s.removed
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	// delete any bodies which are not in the index (e.g. written before a crash) along with any temporary files
+	files, err := os.ReadDir(filepath.Join(dir, "objects"))
+	if err != nil {
+		s.journal.Close()
+		return nil, err
+	}
+	for _, f := range files {
+		if s.objects[f.Name()] == 0 {
+			os.Remove(filepath.Join(dir, "objects", f.Name()))
+		}
+	}
+	return s, nil
+}
+
+// replay loads the responses recorded in the index (if there is one) stopping at any incomplete record
+func (s *diskStore) replay() error {
+	f, err := os.Open(filepath.Join(s.dir, "index"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	decoder := json.NewDecoder(f)
+	for {
+		var record diskRecord
+		if err := decoder.Decode(&record); err != nil {
+			return nil
+		}
+		if record.Remove != "" {
+			if entry, ok := s.ids[record.Remove]; ok {
+				s.index.discard(entry)
+			}
+		}
+		if record.Add != nil {
+			entry := record.Add.entry()
+			if stored, ok := s.ids[diskID(entry)]; ok {
+				s.index.discard(stored)
+			}
+			s.indexed(entry)
+		}
+	}
+}
+
+// compact rewrites the index so that it only records the responses stored (least recently used first)
+// replacing it atomically and reopening it for appending records
+func (s *diskStore) compact() error {
+	s.mu.Lock()
+	if s.compacting || s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, entry := range s.index.oldest() {
+		encoder.Encode(diskRecord{Add: newDiskEntry(entry)})
+	}
+	records := len(s.ids)
+	s.compacting, s.pending = true, nil
+	s.mu.Unlock()
+
+	path := filepath.Join(s.dir, "index")
+	err := writeFileAtomically(path, buffer.Bytes())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := s.pending
+	s.compacting, s.pending = false, nil
+	if err != nil || s.closed {
+		return err
+	}
+	if s.journal != nil {
+		s.journal.Close()
+		s.journal = nil
+	}
+	journal, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	// (append the records appended to the index being replaced since it was read)
+	for _, line := range pending {
+		if _, err := journal.Write(line); err != nil {
+			journal.Close()
+			return err
+		}
+	}
+	s.journal, s.records = journal, records+len(pending)
+	return nil
+}
+
+// record appends a record to the index (s.mu must be held)
+// (records which can not be written are lost, which at worst means responses are no longer stored after a restart)
+func (s *diskStore) record(record diskRecord) error {
+	if s.journal == nil {
+		return nil
+	}
+	line, _ := json.Marshal(record)
+	line = append(line, '\n')
+	if s.compacting {
+		s.pending = append(s.pending, line)
+	}
+	if _, err := s.journal.Write(line); err != nil {
+		return err
+	}
+	s.records++
+	return nil
+}
+
+// compacted compacts the index once it holds more than twice as many records as responses
+func (s *diskStore) compacted() {
+	s.mu.Lock()
+	compact := s.journal != nil && !s.compacting && s.records > 2*len(s.ids)+1024
+	s.mu.Unlock()
+	if compact {
+		s.compact()
+	}
+}
+
+func (s *diskStore) variants(url string) []*cacheEntry {
+	return s.index.variants(url)
+}
+
+func (s *diskStore) load(entry *cacheEntry) (*cacheEntry, bool) {
+	if _, ok := s.index.load(entry); !ok {
+		return nil, false
+	}
+	loaded := *entry
+	if entry.bodyHash != "" {
+		body, err := os.ReadFile(s.objectPath(entry.bodyHash))
+		if err != nil || contentHash(body) != entry.bodyHash {
+			// (the body is missing or corrupt)
+			s.mu.Lock()
+			s.index.discard(entry)
+			s.unlock()
+			s.compacted()
+			return nil, false
+		}
+		loaded.body = body
+	}
+	return &loaded, true
+}
+
+func (s *diskStore) add(entry *cacheEntry, replaces func(stored *cacheEntry) bool) {
+	indexed := *entry
+	indexed.body = nil
+	if entry.body != nil {
+		indexed.bodyHash = contentHash(entry.body)
+		// (the body is referenced straight away so it is not deleted along with any response which shares it)
+		s.mu.Lock()
+		s.objects[indexed.bodyHash]++
+		s.mu.Unlock()
+		s.files.Lock()
+		_, err := os.Stat(s.objectPath(indexed.bodyHash))
+		if err != nil {
+			err = writeFileAtomically(s.objectPath(indexed.bodyHash), entry.body)
+		}
+		s.files.Unlock()
+		if err != nil {
+			s.mu.Lock()
+			s.release(indexed.bodyHash)
+			s.unlock()
+			return
+		}
+	}
+	s.mu.Lock()
+	id := diskID(&indexed)
+	// (the response stored for the same request is removed before this one is recorded so it is not removed on replay)
+	if stored, ok := s.ids[id]; ok {
+		s.index.discard(stored)
+	}
+	if err := s.record(diskRecord{Add: newDiskEntry(&indexed)}); err != nil {
+		s.release(indexed.bodyHash)
+		s.unlock()
+		return
+	}
+	s.index.add(&indexed, replaces)
+	s.ids[id] = &indexed
+	s.unlock()
+	s.compacted()
+}
+
+// indexed adds a response loaded from the index to the index held in memory
+func (s *diskStore) indexed(entry *cacheEntry) {
+	if entry.bodyHash != "" {
+		s.objects[entry.bodyHash]++
+	}
+	s.index.add(entry, nil)
+	s.ids[diskID(entry)] = entry
+}
+
+func (s *diskStore) removeAll(url string) {
+	s.mu.Lock()
+	s.index.removeAll(url)
+	s.unlock()
+	s.compacted()
+}
+
+// removed records a response removed from the index held in memory (including those evicted)
+// deleting its body once no other responses share it (s.mu must be held)
+func (s *diskStore) removed(entry *cacheEntry) {
+	id := diskID(entry)
+	if s.ids[id] == entry {
+		delete(s.ids, id)
+	}
+	s.record(diskRecord{Remove: id})
+	s.release(entry.bodyHash)
+}
+
+// release drops a reference to a body, deleting it once no responses reference it (see unlock)
+// (bodies are only deleted once the index has been loaded as a later response in the index may share them)
+// (s.mu must be held)
+func (s *diskStore) release(hash string) {
+	if hash == "" {
+		return
+	}
+	if s.objects[hash]--; s.objects[hash] <= 0 {
+		delete(s.objects, hash)
+		if s.journal != nil {
+			s.unused = append(s.unused, hash)
+		}
+	}
+}
+
+// unlock releases s.mu and then deletes the bodies which are no longer referenced
+// (unless they have been referenced again by a response added meanwhile)
+func (s *diskStore) unlock() {
+	unused := s.unused
+	s.unused = nil
+	s.mu.Unlock()
+	if len(unused) == 0 {
+		return
+	}
+	s.files.Lock()
+	defer s.files.Unlock()
+	for _, hash := range unused {
+		s.mu.Lock()
+		referenced := s.objects[hash] > 0
+		s.mu.Unlock()
+		if !referenced {
+			os.Remove(s.objectPath(hash))
+		}
+	}
+}
+
+func (s *diskStore) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.journal == nil {
+		return nil
+	}
+	err := s.journal.Close()
+	s.journal = nil
+	return err
+}
+
+func (s *diskStore) objectPath(hash string) string {
+	return filepath.Join(s.dir, "objects", hash)
+}
+
+// diskID identifies a response in the index of a diskStore by the variant of the request it is stored for
+func diskID(entry *cacheEntry) string {
+	return contentHash([]byte(entry.variant()))
+}
+
+// contentHash returns the SHA-256 hash of some content (as hex)
+func contentHash(content []byte) string {
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])
+}
+
+// writeFileAtomically writes a file via a temporary file which is synced before being renamed into place
+// (syncing its directory) so that the file is either written completely or not at all
+func writeFileAtomically(path string, content []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, bytes.NewReader(content))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir syncs a directory so that the files renamed into it survive a power loss
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func newDiskEntry(entry *cacheEntry) *diskEntry {
+	return &diskEntry{
+		URL:                  entry.url,
+		Host:                 entry.host,
+		Vary:                 entry.varyValues,
+		Status:               entry.status,
+		StatusCode:           entry.statusCode,
+		Proto:                entry.proto,
+		Header:               entry.header,
+		Body:                 entry.bodyHash,
+		RequestTime:          entry.requestTime,
+		ResponseTime:         entry.responseTime,
+		Freshness:            entry.freshness,
+		StaleWhileRevalidate: entry.staleWhileRevalidate,
+		StaleIfError:         entry.staleIfError,
+		Size:                 entry.size,
+	}
+}
+
+func (e *diskEntry) entry() *cacheEntry {
+	varyValues := e.Vary
+	if varyValues == nil {
+		varyValues = make(map[string]string)
+	}
+	return &cacheEntry{
+		url:                  e.URL,
+		host:                 e.Host,
+		varyValues:           varyValues,
+		status:               e.Status,
+		statusCode:           e.StatusCode,
+		proto:                e.Proto,
+		header:               e.Header,
+		requestTime:          e.RequestTime,
+		responseTime:         e.ResponseTime,
+		freshness:            e.Freshness,
+		staleWhileRevalidate: e.StaleWhileRevalidate,
+		staleIfError:         e.StaleIfError,
+		size:                 e.Size,
+		bodyHash:             e.Body,
+	}
+}
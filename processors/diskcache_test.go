@@ -0,0 +1,125 @@
+package processors
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDiskCaching(t *testing.T) {
+	var calls int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := atomic.AddInt64(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.URL.Query().Get("shared") != "" {
+			w.Write([]byte("shared"))
+			return
+		}
+		w.Write([]byte(r.URL.Path + " " + strconv.FormatInt(call, 10)))
+	}))
+	defer upstream.Close()
+
+	dir, err := ioutil.TempDir("", "rrp-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	open := func(maxBytes int64) {
+		if Caching != nil {
+			Caching.Close()
+		}
+		cache, err := NewDiskCache(dir, maxBytes)
+		if err != nil {
+			t.Fatalf("\t\tShould open the disk cache, but received %v %v", err, cross)
+		}
+		Caching = cache
+	}
+	defer func() {
+		Caching.Close()
+		Caching = nil
+	}()
+	get := func(path string) *BatchedResponse {
+		request, _ := http.NewRequest("GET", upstream.URL+path, nil)
+		responses, _ := ProcessBatch([]*http.Request{request}, DefaultTimeout, BatchOptions{})
+		return responses[0]
+	}
+	objects := func() int {
+		files, _ := ioutil.ReadDir(filepath.Join(dir, "objects"))
+		return len(files)
+	}
+
+	t.Log("We should be able to serve responses stored on disk after a restart")
+	{
+		open(1 << 20)
+		first := body(get("/warm"))
+		open(1 << 20)
+		if second := get("/warm"); second.Header.Get(CacheHeader) == "HIT" && body(second) == first {
+			t.Log("\t\tShould reload the index and serve the stored response", tick)
+		} else {
+			t.Errorf("\t\tShould reload the index and serve the stored response, but received %v %v", second.Header, cross)
+		}
+	}
+
+	t.Log("We should store the bodies of responses by their content")
+	{
+		before := objects()
+		get("/one?shared=1")
+		get("/two?shared=1")
+		if get("/two?shared=1").Header.Get(CacheHeader) == "HIT" && objects() == before+1 {
+			t.Log("\t\tShould store a body shared by responses once", tick)
+		} else {
+			t.Errorf("\t\tShould store a body shared by responses once, but found %d bodies %v", objects()-before, cross)
+		}
+	}
+
+	t.Log("We should recover from a crash")
+	{
+		index, _ := os.OpenFile(filepath.Join(dir, "index"), os.O_WRONLY|os.O_APPEND, 0o644)
+		index.Write([]byte(`{"add":{"url":"http://`))
+		index.Close()
+		ioutil.WriteFile(filepath.Join(dir, "objects", "tmp-123"), []byte("partial"), 0o644)
+		before := objects()
+		open(1 << 20)
+		if get("/warm").Header.Get(CacheHeader) == "HIT" && objects() == before-1 {
+			t.Log("\t\tShould ignore an incomplete record in the index and delete bodies which are not in the index", tick)
+		} else {
+			t.Errorf("\t\tShould ignore an incomplete record in the index and delete bodies which are not in the index %v", cross)
+		}
+		store := Caching.store.(*diskStore)
+		entry := store.index.variants(upstream.URL + "/warm")[0]
+		ioutil.WriteFile(store.objectPath(entry.bodyHash), []byte("corrupt"), 0o644)
+		if response := get("/warm"); response.Header.Get(CacheHeader) == "MISS" && body(response) != "corrupt" {
+			t.Log("\t\tShould not serve a response with a corrupt body", tick)
+		} else {
+			t.Errorf("\t\tShould not serve a response with a corrupt body, but received %v %v", response.Header, cross)
+		}
+	}
+
+	t.Log("We should evict the least recently used responses once the disk cache is full")
+	{
+		os.RemoveAll(dir)
+		open(1 << 20)
+		get("/lru?n=1")
+		// (the cache only has room for 2 responses)
+		store := Caching.store.(*diskStore)
+		open(store.index.used*2 + store.index.used/2)
+		get("/lru?n=2")
+		get("/lru?n=1")
+		get("/lru?n=3")
+		if get("/lru?n=1").Header.Get(CacheHeader) == "HIT" && get("/lru?n=2").Header.Get(CacheHeader) == "MISS" {
+			t.Log("\t\tShould evict the least recently used response", tick)
+		} else {
+			t.Errorf("\t\tShould evict the least recently used response %v", cross)
+		}
+		if objects() == 2 {
+			t.Log("\t\tShould delete the bodies of the responses evicted", tick)
+		} else {
+			t.Errorf("\t\tShould delete the bodies of the responses evicted, but found %d bodies %v", objects(), cross)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package processors
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// LegacyErrors restores the original behaviour of returning any error sending an individual request as a 400 (Bad Request)
+// with the error message as its status e.g. `400 net/http: timeout awaiting response headers` (for compatibility with
+// existing clients). By default errors are classified and returned with a meaningful status code (see classifyError).
+var LegacyErrors bool
+
+// errorBody is the JSON body of the response for an individual request which failed
+type errorBody struct {
+	Error errorDetail `json:"error"`
+}
+
+type errorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// newErrorBody returns the JSON body of the response for an individual request which failed
+func newErrorBody(code string, err error) []byte {
+	body, _ := json.Marshal(errorBody{errorDetail{Code: code, Message: err.Error()}})
+	return body
+}
+
+// classifyError works out the status code and machine-readable code for an error sending an individual request
+//
+//	504 (Gateway Timeout) timeout            - the request timed out
+//	502 (Bad Gateway)     dns_error          - the host could not be resolved
+//	502 (Bad Gateway)     connection_refused - the host refused the connection
+//	502 (Bad Gateway)     tls_error          - the TLS handshake failed (e.g. the certificate is invalid)
+//	502 (Bad Gateway)     connection_failed  - the connection could not be made for any other reason
+//	502 (Bad Gateway)     connection_reset   - the connection was closed before the response was received
+//	502 (Bad Gateway)     transport_error    - any other error
+func classifyError(err error, timedOut bool) (statusCode int, code string) {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var recordErr tls.RecordHeaderError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certificateErr x509.CertificateInvalidError
+	switch {
+	case timedOut || errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		return http.StatusGatewayTimeout, "timeout"
+	case errors.As(err, &dnsErr):
+		return http.StatusBadGateway, "dns_error"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return http.StatusBadGateway, "connection_refused"
+	case errors.As(err, &recordErr), errors.As(err, &unknownAuthorityErr), errors.As(err, &hostnameErr), errors.As(err, &certificateErr),
+		strings.Contains(err.Error(), "tls: "), strings.Contains(err.Error(), "x509: "):
+		return http.StatusBadGateway, "tls_error"
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return http.StatusBadGateway, "connection_failed"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return http.StatusBadGateway, "connection_reset"
+	}
+	return http.StatusBadGateway, "transport_error"
+}
+
+// transportErrorResponse returns the response for an individual request which could not be sent (or its response could not be read)
+func transportErrorResponse(sequence int, proto string, err error, timeout time.Duration, startedProcessing time.Time) BatchedResponse {
+	if LegacyErrors {
+		return errorResponse(sequence, proto, err, timeout, startedProcessing)
+	}
+	statusCode, code := classifyError(err, time.Since(startedProcessing) > timeout)
+	response := ErrorResponse(sequence, proto, statusCode, code, err)
+	response.ProcessingDuration, response.Started = time.Since(startedProcessing), startedProcessing
+	return *response
+}
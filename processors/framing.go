@@ -0,0 +1,36 @@
+package processors
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// keepEncoding asks for a compressed response to a request so that its body is passed through verbatim
+// (http.Transport only decompresses a response transparently when it added the `Accept-Encoding` header itself)
+func keepEncoding(request *http.Request) {
+	if request.Header == nil {
+		request.Header = http.Header{}
+	}
+	if request.Header.Get("Accept-Encoding") == "" {
+		request.Header.Set("Accept-Encoding", "gzip, deflate")
+	}
+}
+
+// normaliseFraming recomputes the framing headers of a response to match the body buffered for it
+// (the body may have been decompressed by http.Transport and is no longer sent chunked)
+func normaliseFraming(response *http.Response, body []byte, method string) {
+	header := response.Header
+	header.Del("Transfer-Encoding")
+	if response.Uncompressed {
+		header.Del("Content-Encoding")
+	}
+	switch {
+	case response.StatusCode == http.StatusNoContent || (response.StatusCode >= 100 && response.StatusCode < 200):
+		// (these responses never have a body or a Content-Length header)
+		header.Del("Content-Length")
+	case method == http.MethodHead || response.StatusCode == http.StatusNotModified:
+		// (the Content-Length header of these responses gives the size of the body which would have been sent so is left as is)
+	default:
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+}
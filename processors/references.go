@@ -0,0 +1,325 @@
+package processors
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// references match `${ID.path}` where ID is the ID of an earlier request in the batch and path is one of
+//
+//	status              - the status code of its response e.g. `${item1.status}`
+//	header.<name>       - a header of its response e.g. `${item1.header.Location}`
+//	body                - the body of its response
+//	body.<json path>    - a value from its JSON response body e.g. `${item1.body.data.items.0.id}`
+var references = regexp.MustCompile(`\$\{([^{}]+)\}`)
+
+// escapedReferences match references in the path of a URL (where `{` and `}` are escaped)
+var escapedReferences = regexp.MustCompile(`\$%7[Bb](.+?)%7[Dd]`)
+
+// referenceableURL returns the URL of a request with any references in its path unescaped
+func referenceableURL(u *url.URL) string {
+	return escapedReferences.ReplaceAllString(u.String(), "$${${1}}")
+}
+
+// findDependencies returns the sequences of the earlier requests in the batch which the specified request depends on.
+// These are the dependencies specified in its PartOptions along with any requests it references.
+func findDependencies(sequence int, request *http.Request, parts []PartOptions) ([]int, error) {
+	seen := make(map[int]bool)
+	var dependencies []int
+	add := func(d int) error {
+		if d < 0 || d >= sequence {
+			return fmt.Errorf("invalid dependency on request %d, a request can only depend on earlier requests in the batch", d)
+		}
+		if !seen[d] {
+			seen[d] = true
+			dependencies = append(dependencies, d)
+		}
+		return nil
+	}
+	for _, d := range parts[sequence].DependsOn {
+		if err := add(d); err != nil {
+			return nil, err
+		}
+	}
+	if !hasIDs(parts) {
+		return dependencies, nil
+	}
+	content, err := referenceableContent(request)
+	if err != nil {
+		return nil, err
+	}
+	for _, match := range references.FindAllStringSubmatch(content, -1) {
+		if d, _, ok := lookupReference(match[1], parts); ok {
+			if err := add(d); err != nil {
+				return nil, fmt.Errorf("invalid reference %s: %s", match[0], err.Error())
+			}
+		}
+	}
+	return dependencies, nil
+}
+
+func hasIDs(parts []PartOptions) bool {
+	for _, p := range parts {
+		if p.ID != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// referenceableContent returns the parts of a request which can contain references i.e. its URL, headers and body
+// (the body is read into memory and replaced so it can still be sent)
+func referenceableContent(request *http.Request) (string, error) {
+	var buf bytes.Buffer
+	buf.WriteString(referenceableURL(request.URL))
+	for _, values := range request.Header {
+		for _, v := range values {
+			buf.WriteString("\n" + v)
+		}
+	}
+	body, err := readBody(request)
+	if err != nil {
+		return "", err
+	}
+	buf.WriteString("\n")
+	buf.Write(body)
+	return buf.String(), nil
+}
+
+// readBody reads the body of a request, replacing it so that it can still be sent
+func readBody(request *http.Request) ([]byte, error) {
+	if request.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(request.Body)
+	request.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	setBody(request, body)
+	return body, nil
+}
+
+func setBody(request *http.Request, body []byte) {
+	request.ContentLength = int64(len(body))
+	request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	request.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+}
+
+// lookupReference finds the request referenced by a reference expression (the content of `${...}`)
+// returning its sequence and the path of the value referenced.
+// As IDs can contain `.` the longest matching ID is used.
+func lookupReference(expression string, parts []PartOptions) (sequence int, path string, ok bool) {
+	matched := -1
+	for i, p := range parts {
+		if p.ID == "" || !strings.HasPrefix(expression, p.ID+".") {
+			continue
+		}
+		if matched < 0 || len(p.ID) > len(parts[matched].ID) {
+			matched = i
+		}
+	}
+	if matched < 0 {
+		return 0, "", false
+	}
+	return matched, expression[len(parts[matched].ID)+1:], true
+}
+
+// resolveReferences replaces any references to earlier requests in the URL, headers and body of a request
+// with the values from their responses (references to unknown IDs are left as is). The values are escaped for where
+// they are referenced so that they can not change the structure of the request (see urlEscaper and jsonEscaper).
+func resolveReferences(request *http.Request, parts []PartOptions, results []BatchedResponse) error {
+	var resolveErr error
+	resolve := func(s string, escape func(value string, at int) string) string {
+		var resolved strings.Builder
+		last := 0
+		for _, m := range references.FindAllStringIndex(s, -1) {
+			match := s[m[0]:m[1]]
+			resolved.WriteString(s[last:m[0]])
+			last = m[1]
+			d, path, ok := lookupReference(match[2:len(match)-1], parts)
+			if !ok {
+				resolved.WriteString(match)
+				continue
+			}
+			value, err := referencedValue(&results[d], path)
+			if err != nil && resolveErr == nil {
+				resolveErr = fmt.Errorf("unable to resolve reference %s: %s", match, err.Error())
+			}
+			resolved.WriteString(escape(value, m[0]))
+		}
+		resolved.WriteString(s[last:])
+		return resolved.String()
+	}
+
+	u := referenceableURL(request.URL)
+	resolvedURL, err := url.Parse(resolve(u, urlEscaper(u)))
+	if err != nil {
+		return err
+	}
+	// (the Host header is only reset if the reference changed the host, so one set explicitly is otherwise kept)
+	if resolvedURL.Host != request.URL.Host {
+		request.Host = resolvedURL.Host
+	}
+	request.URL = resolvedURL
+	for k, values := range request.Header {
+		for i, v := range values {
+			request.Header[k][i] = resolve(v, unescaped)
+		}
+	}
+	body, err := readBody(request)
+	if err != nil {
+		return err
+	}
+	if len(body) > 0 {
+		escape := unescaped
+		if mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type")); mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+			escape = jsonEscaper(string(body))
+		}
+		setBody(request, []byte(resolve(string(body), escape)))
+	}
+	return resolveErr
+}
+
+// unescaped substitutes a referenced value as is
+func unescaped(value string, at int) string {
+	return value
+}
+
+// urlEscaper returns how to escape the values referenced in a URL (at an index of u) so that they do not change its
+// structure. Values in the path are path escaped (e.g. `/` becomes `%2F`) and values in the query are query escaped
+// (e.g. `&` becomes `%26`). Values at the start of the URL or in its host are substituted as is (so a reference can
+// provide the URL to send the request to e.g. `${item1.header.Location}`).
+func urlEscaper(u string) func(value string, at int) string {
+	// (the references are masked so that the structure of the URL is found without them)
+	masked := references.ReplaceAllStringFunc(u, func(match string) string {
+		return strings.Repeat("x", len(match))
+	})
+	path := 0
+	if i := strings.Index(masked, "://"); i >= 0 {
+		if path = strings.IndexByte(masked[i+3:], '/'); path >= 0 {
+			path += i + 3
+		} else {
+			path = len(masked)
+		}
+	}
+	query, fragment := strings.IndexByte(masked, '?'), strings.IndexByte(masked, '#')
+	if fragment >= 0 && query > fragment {
+		query = -1
+	}
+	return func(value string, at int) string {
+		switch {
+		case at == 0 || at < path:
+			return value
+		case query >= 0 && at > query && (fragment < 0 || at < fragment):
+			return url.QueryEscape(value)
+		default:
+			return url.PathEscape(value)
+		}
+	}
+}
+
+// jsonEscaper returns how to escape the values referenced in a JSON body (at an index of body) so that it is still
+// valid. Values in a string are escaped as its content (e.g. `"` becomes `\"`). Values elsewhere are substituted as is
+// if they are JSON (e.g. a number or an object) or as a string otherwise.
+func jsonEscaper(body string) func(value string, at int) string {
+	// (inString records whether each index of the body is in a string)
+	inString := make([]bool, len(body))
+	in, escaped := false, false
+	for i := 0; i < len(body); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case in && body[i] == '\\':
+			escaped = true
+		case body[i] == '"':
+			in = !in
+		}
+		inString[i] = in
+	}
+	return func(value string, at int) string {
+		if !inString[at] && json.Valid([]byte(value)) {
+			return value
+		}
+		var quoted bytes.Buffer
+		encoder := json.NewEncoder(&quoted)
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(value)
+		if inString[at] {
+			return string(quoted.Bytes()[1 : quoted.Len()-2])
+		}
+		return string(bytes.TrimSpace(quoted.Bytes()))
+	}
+}
+
+// referencedValue returns the value at the specified path of a response (see references)
+func referencedValue(response *BatchedResponse, path string) (string, error) {
+	switch {
+	case path == "status":
+		return strconv.Itoa(response.StatusCode), nil
+	case strings.HasPrefix(path, "header."):
+		if response.Header == nil || response.Header.Get(path[len("header."):]) == "" {
+			return "", fmt.Errorf("no %s header in response", path[len("header."):])
+		}
+		return response.Header.Get(path[len("header."):]), nil
+	case path == "body" || strings.HasPrefix(path, "body."):
+		var body []byte
+		if response.Body != nil {
+			// (ReadAt is used so the response can still be read as normal)
+			body = make([]byte, response.Body.Size())
+			if _, err := response.Body.ReadAt(body, 0); err != nil && err != io.EOF {
+				return "", err
+			}
+		}
+		if path == "body" {
+			return string(body), nil
+		}
+		return jsonValue(body, strings.Split(path[len("body."):], "."))
+	}
+	return "", fmt.Errorf("unsupported path %s, expected status, header.<name>, body or body.<json path>", path)
+}
+
+// jsonValue returns the value at the specified path of a JSON document.
+// Strings are returned as is, other values are returned as JSON.
+func jsonValue(document []byte, path []string) (string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return "", fmt.Errorf("invalid JSON body: %s", err.Error())
+	}
+	for _, key := range path {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			next, ok := v[key]
+			if !ok {
+				return "", fmt.Errorf("no %s in JSON body", key)
+			}
+			value = next
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return "", fmt.Errorf("invalid index %s in JSON body", key)
+			}
+			value = v[i]
+		default:
+			return "", fmt.Errorf("no %s in JSON body", key)
+		}
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(value)
+	return string(b), err
+}
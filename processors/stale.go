@@ -0,0 +1,143 @@
+package processors
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// staleStatusCodes are the status codes of responses from the origin which are treated as errors
+// so that a stale response can be served instead (as per RFC 5861 section 4)
+var staleStatusCodes = map[int]bool{500: true, 502: true, 503: true, 504: true}
+
+// ParseStaleDefaults parses a comma separated list of host=seconds pairs
+// e.g. `api.example.com=30,.example.org=60,*=10` for use as Cache.StaleWhileRevalidate or Cache.StaleIfError
+func ParseStaleDefaults(value string) (map[string]time.Duration, error) {
+	defaults := map[string]time.Duration{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid default %q, expected host=seconds", pair)
+		}
+		host := strings.ToLower(strings.TrimSpace(kv[0]))
+		d, ok := seconds(strings.TrimSpace(kv[1]))
+		if !ok {
+			return nil, fmt.Errorf("invalid default %q for %s, expected a whole number of seconds", strings.TrimSpace(kv[1]), host)
+		}
+		defaults[host] = d
+	}
+	return defaults, nil
+}
+
+// hostDefault returns the default configured for a host, matching the host (including its port), its hostname,
+// the longest `.suffix` of its hostname and finally `*` (in that order)
+func hostDefault(defaults map[string]time.Duration, host string) time.Duration {
+	host = strings.ToLower(host)
+	if d, ok := defaults[host]; ok {
+		return d
+	}
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	if d, ok := defaults[hostname]; ok {
+		return d
+	}
+	suffix := ""
+	for h := range defaults {
+		if strings.HasPrefix(h, ".") && strings.HasSuffix(hostname, h) && len(h) > len(suffix) {
+			suffix = h
+		}
+	}
+	if suffix != "" {
+		return defaults[suffix]
+	}
+	return defaults["*"]
+}
+
+// staleLifetimes returns how long a stale response can be served while it is revalidated in the background and
+// how long if the origin fails as per its `Cache-Control: stale-while-revalidate` and `stale-if-error` directives
+// (RFC 5861), or -1 if it has no such directive so that the defaults for its host apply (see staleLifetime).
+// Responses which must be revalidated are never served stale.
+func staleLifetimes(directives map[string]string) (whileRevalidate time.Duration, ifError time.Duration) {
+	for _, d := range []string{"must-revalidate", "proxy-revalidate", "no-cache"} {
+		if _, ok := directives[d]; ok {
+			return 0, 0
+		}
+	}
+	whileRevalidate, ifError = -1, -1
+	if value, ok := directives["stale-while-revalidate"]; ok {
+		whileRevalidate, _ = seconds(value)
+	}
+	if value, ok := directives["stale-if-error"]; ok {
+		ifError, _ = seconds(value)
+	}
+	return whileRevalidate, ifError
+}
+
+// staleLifetime returns how long a stale response for a host can be served, as per its directive
+// or otherwise the defaults (either Cache.StaleWhileRevalidate or Cache.StaleIfError)
+func staleLifetime(lifetime time.Duration, defaults map[string]time.Duration, host string) time.Duration {
+	if lifetime >= 0 {
+		return lifetime
+	}
+	return hostDefault(defaults, host)
+}
+
+// staleness returns how long a stored response has been stale for (zero or less while it is fresh)
+func (e *cacheEntry) staleness(now time.Time) time.Duration {
+	return e.age(now) - e.freshness
+}
+
+// whileRevalidating returns the response stored for a request (see lookup) if it is stale but can be served while it
+// is revalidated (see Cache.StaleWhileRevalidate), starting its revalidation in the background with send unless it is
+// already being revalidated. The response is marked as served stale from the cache with a `x-rrp-cache: STALE` header.
+func (c *Cache) whileRevalidating(r batchedRequest, entry *cacheEntry, send func(r batchedRequest) BatchedResponse) (BatchedResponse, bool) {
+	started := time.Now()
+	if entry == nil {
+		return BatchedResponse{}, false
+	}
+	if staleness := entry.staleness(started); staleness <= 0 || staleness > staleLifetime(entry.staleWhileRevalidate, c.StaleWhileRevalidate, entry.host) {
+		return BatchedResponse{}, false
+	}
+	variant := entry.variant()
+	c.mu.Lock()
+	refreshing := c.refreshing[variant]
+	c.refreshing[variant] = true
+	c.mu.Unlock()
+	if !refreshing {
+		// (the revalidation outlives the batch so is not cancelled along with it, the client's timeout still applies)
+		background := r
+		background.Request = r.Request.Clone(context.Background())
+		go func() {
+			defer func() {
+				c.mu.Lock()
+				delete(c.refreshing, variant)
+				c.mu.Unlock()
+			}()
+			send(background)
+		}()
+	}
+	return entry.response(r.Sequence, started, "STALE"), true
+}
+
+// ifError returns a stale response stored in the cache in place of the response to a request which failed (it could
+// not be sent or the origin responded with a 500, 502, 503 or 504) if it can be served in the event of an error
+// (see Cache.StaleIfError). The response is marked as served stale from the cache with a `x-rrp-cache: STALE` header.
+func (c *Cache) ifError(entry *cacheEntry, failed BatchedResponse, err error) (BatchedResponse, bool) {
+	if entry == nil || (err == nil && !staleStatusCodes[failed.StatusCode]) {
+		return BatchedResponse{}, false
+	}
+	if entry.staleness(time.Now()) > staleLifetime(entry.staleIfError, c.StaleIfError, entry.host) {
+		return BatchedResponse{}, false
+	}
+	response := entry.response(failed.Sequence, failed.Started, "STALE")
+	response.ProcessingDuration = failed.ProcessingDuration
+	return response, true
+}
@@ -0,0 +1,150 @@
+package processors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStaleCaching(t *testing.T) {
+	var calls, revalidations int64
+	var failing int32
+	revalidating, closing := make(chan struct{}, 1), make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := atomic.AddInt64(&calls, 1)
+		switch r.URL.Path {
+		case "/while-revalidate":
+			w.Header().Set("Cache-Control", "max-age=60, stale-while-revalidate=60")
+			// (only the first response is already stale when received, the second is sent to revalidate it)
+			switch atomic.AddInt64(&revalidations, 1) {
+			case 1:
+				w.Header().Set("Age", "90")
+			case 2:
+				revalidating <- struct{}{}
+			}
+		case "/if-error", "/timeout":
+			w.Header().Set("Cache-Control", "max-age=60, stale-if-error=300")
+			w.Header().Set("Age", "90")
+		case "/must-revalidate":
+			w.Header().Set("Cache-Control", "max-age=60, must-revalidate, stale-if-error=300")
+			w.Header().Set("Age", "90")
+		case "/default":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Age", "90")
+		}
+		if atomic.LoadInt32(&failing) == 1 {
+			// (a request to /timeout is only responded to once the client has given up on it)
+			if r.URL.Path == "/timeout" {
+				select {
+				case <-r.Context().Done():
+				case <-closing:
+				}
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(r.URL.Path + " " + strconv.FormatInt(call, 10)))
+	}))
+	defer upstream.Close()
+	defer close(closing)
+
+	Caching = NewCache(1 << 20)
+	defer func() { Caching = nil }()
+
+	get := func(path string, timeout time.Duration) *BatchedResponse {
+		request, _ := http.NewRequest("GET", upstream.URL+path, nil)
+		responses, _ := ProcessBatch([]*http.Request{request}, timeout, BatchOptions{})
+		return responses[0]
+	}
+
+	t.Log("We should be able to serve stale responses from the cache while they are revalidated in the background")
+	{
+		first := body(get("/while-revalidate", DefaultTimeout))
+		stale := get("/while-revalidate", DefaultTimeout)
+		if stale.Header.Get(CacheHeader) == "STALE" && body(stale) == first {
+			t.Log("\t\tShould serve the stale response straight away", tick)
+		} else {
+			t.Errorf("\t\tShould serve the stale response straight away, but received %v %v", stale.Header, cross)
+		}
+		// (wait for the revalidation in the background to be sent and then complete)
+		waitForSignal(t, revalidating, "revalidate the response in the background")
+		waitFor(t, func() bool {
+			Caching.mu.Lock()
+			defer Caching.mu.Unlock()
+			return len(Caching.refreshing) == 0
+		}, "store the revalidated response")
+		if refreshed := get("/while-revalidate", DefaultTimeout); refreshed.Header.Get(CacheHeader) == "HIT" && body(refreshed) != first {
+			t.Log("\t\tShould refresh the response in the cache", tick)
+		} else {
+			t.Errorf("\t\tShould refresh the response in the cache, but received %v %v", refreshed.Header, cross)
+		}
+	}
+
+	t.Log("We should be able to serve stale responses from the cache if the origin fails")
+	{
+		first := body(get("/if-error", DefaultTimeout))
+		get("/timeout", DefaultTimeout)
+		get("/must-revalidate", DefaultTimeout)
+		get("/default", DefaultTimeout)
+		atomic.StoreInt32(&failing, 1)
+		defer atomic.StoreInt32(&failing, 0)
+
+		if stale := get("/if-error", DefaultTimeout); stale.StatusCode == http.StatusOK && stale.Header.Get(CacheHeader) == "STALE" && body(stale) == first {
+			t.Log("\t\tShould serve the stale response in place of a 503 (Service Unavailable)", tick)
+		} else {
+			t.Errorf("\t\tShould serve the stale response in place of a 503 (Service Unavailable), but received %d %v %v", stale.StatusCode, stale.Header, cross)
+		}
+		if stale := get("/timeout", 50*time.Millisecond); stale.StatusCode == http.StatusOK && stale.Header.Get(CacheHeader) == "STALE" {
+			t.Log("\t\tShould serve the stale response in place of a timeout", tick)
+		} else {
+			t.Errorf("\t\tShould serve the stale response in place of a timeout, but received %d %v %v", stale.StatusCode, stale.Header, cross)
+		}
+		if response := get("/must-revalidate", DefaultTimeout); response.StatusCode == http.StatusServiceUnavailable {
+			t.Log("\t\tShould not serve a stale response which must be revalidated", tick)
+		} else {
+			t.Errorf("\t\tShould not serve a stale response which must be revalidated, but received %d %v", response.StatusCode, cross)
+		}
+		if response := get("/default", DefaultTimeout); response.StatusCode == http.StatusServiceUnavailable {
+			t.Log("\t\tShould not serve a stale response without a stale-if-error directive or default", tick)
+		} else {
+			t.Errorf("\t\tShould not serve a stale response without a stale-if-error directive or default, but received %d %v", response.StatusCode, cross)
+		}
+		Caching.StaleIfError = map[string]time.Duration{"127.0.0.1": 5 * time.Minute}
+		if stale := get("/default", DefaultTimeout); stale.StatusCode == http.StatusOK && stale.Header.Get(CacheHeader) == "STALE" {
+			t.Log("\t\tShould serve a stale response as per the default configured for its host", tick)
+		} else {
+			t.Errorf("\t\tShould serve a stale response as per the default configured for its host, but received %d %v %v", stale.StatusCode, stale.Header, cross)
+		}
+	}
+
+	t.Log("We should be able to configure defaults for serving stale responses for each host")
+	{
+		defaults, err := ParseStaleDefaults("api.example.com=30, api.example.com:8443=60, .example.org=90, .www.example.org=120, *=10")
+		if err != nil {
+			t.Fatalf("\t\tShould parse the defaults, but received %v %v", err, cross)
+		}
+		for host, expected := range map[string]time.Duration{
+			"api.example.com":      30 * time.Second,
+			"api.example.com:443":  30 * time.Second,
+			"API.example.com:8443": 60 * time.Second,
+			"example.org":          10 * time.Second,
+			"api.example.org":      90 * time.Second,
+			"api.www.example.org":  120 * time.Second,
+			"example.net":          10 * time.Second,
+		} {
+			if d := hostDefault(defaults, host); d == expected {
+				t.Logf("\t\tShould use %v for %s %v", expected, host, tick)
+			} else {
+				t.Errorf("\t\tShould use %v for %s, but received %v %v", expected, host, d, cross)
+			}
+		}
+		if _, err := ParseStaleDefaults("api.example.com=soon"); err != nil {
+			t.Log("\t\tShould return an error for an invalid default", tick)
+		} else {
+			t.Errorf("\t\tShould return an error for an invalid default %v", cross)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package processors
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServerTimingHeader is the header used to return the Timings of a response (https://www.w3.org/TR/server-timing/)
+const ServerTimingHeader = "Server-Timing"
+
+// Timings is the breakdown of the time taken to send an individual request and receive its response.
+// Phases which did not happen (e.g. the DNS lookup and connect for a request sent on a reused connection) are zero.
+type Timings struct {
+	// DNS is the time taken to look up the host
+	DNS time.Duration
+	// Connect is the time taken to establish the TCP connection
+	Connect time.Duration
+	// TLS is the time taken for the TLS handshake
+	TLS time.Duration
+	// FirstByte is the time from when the request was started until the first byte of the response was received
+	FirstByte time.Duration
+	// Transfer is the time from the first byte of the response until its body had been read
+	Transfer time.Duration
+}
+
+// ServerTiming formats the timings (along with the total time taken) as the value of a `Server-Timing` header
+// e.g. `dns;dur=1.2, connect;dur=3.4, tls;dur=5.6, ttfb;dur=20.1, transfer;dur=2.3, total;dur=22.4` (in milliseconds)
+func (t Timings) ServerTiming(total time.Duration) string {
+	metrics := make([]string, 0, 6)
+	for _, m := range t.metrics(total) {
+		metrics = append(metrics, m.name+";dur="+strconv.FormatFloat(float64(m.duration)/float64(time.Millisecond), 'f', -1, 64))
+	}
+	return strings.Join(metrics, ", ")
+}
+
+// String formats the timings (along with the total time taken) for logging
+// e.g. `dns=1.2ms connect=3.4ms tls=5.6ms ttfb=20.1ms transfer=2.3ms total=22.4ms`
+func (t Timings) String(total time.Duration) string {
+	metrics := make([]string, 0, 6)
+	for _, m := range t.metrics(total) {
+		metrics = append(metrics, m.name+"="+m.duration.Round(time.Microsecond).String())
+	}
+	return strings.Join(metrics, " ")
+}
+
+type metric struct {
+	name     string
+	duration time.Duration
+}
+
+func (t Timings) metrics(total time.Duration) []metric {
+	return []metric{{"dns", t.DNS}, {"connect", t.Connect}, {"tls", t.TLS}, {"ttfb", t.FirstByte}, {"transfer", t.Transfer}, {"total", total}}
+}
+
+// SlowestTimings summarises the timings of the responses of a batch as the longest time taken for each phase
+// by any of its requests (as when requests are sent concurrently it is the slowest which hold up the batch)
+func SlowestTimings(responses []*BatchedResponse) Timings {
+	var slowest Timings
+	for _, response := range responses {
+		if response != nil {
+			slowest = slowest.Slowest(response.Timings)
+		}
+	}
+	return slowest
+}
+
+// Slowest returns the longest time taken for each phase by either the timings or other
+// (so the timings of responses can be summarised as they complete, see SlowestTimings)
+func (t Timings) Slowest(other Timings) Timings {
+	max := func(d *time.Duration, v time.Duration) {
+		if v > *d {
+			*d = v
+		}
+	}
+	max(&t.DNS, other.DNS)
+	max(&t.Connect, other.Connect)
+	max(&t.TLS, other.TLS)
+	max(&t.FirstByte, other.FirstByte)
+	max(&t.Transfer, other.Transfer)
+	return t
+}
+
+// requestTrace records when each phase of sending an individual request started and finished using httptrace.
+// (The hooks can be called concurrently e.g. when dialling more than one address so mu guards the times)
+type requestTrace struct {
+	mu                        sync.Mutex
+	started                   time.Time
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	firstByte                 time.Time
+}
+
+func newRequestTrace(started time.Time) *requestTrace {
+	return &requestTrace{started: started}
+}
+
+// clientTrace returns the httptrace.ClientTrace hooks used to record the times
+func (rt *requestTrace) clientTrace() *httptrace.ClientTrace {
+	record := func(t *time.Time, once bool) {
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		if once && !t.IsZero() {
+			return
+		}
+		*t = time.Now()
+	}
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { record(&rt.dnsStart, true) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { record(&rt.dnsDone, false) },
+		ConnectStart: func(network, addr string) {
+			record(&rt.connectStart, true)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err == nil {
+				record(&rt.connectDone, false)
+			}
+		},
+		TLSHandshakeStart: func() { record(&rt.tlsStart, true) },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			record(&rt.tlsDone, false)
+		},
+		GotFirstResponseByte: func() { record(&rt.firstByte, true) },
+	}
+}
+
+// timings works out the Timings from the times recorded given when the body of the response had been read
+// (phases which did not finish are zero)
+func (rt *requestTrace) timings(transferred time.Time) Timings {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	between := func(start, end time.Time) time.Duration {
+		if start.IsZero() || end.IsZero() || end.Before(start) {
+			return 0
+		}
+		return end.Sub(start)
+	}
+	return Timings{
+		DNS:       between(rt.dnsStart, rt.dnsDone),
+		Connect:   between(rt.connectStart, rt.connectDone),
+		TLS:       between(rt.tlsStart, rt.tlsDone),
+		FirstByte: between(rt.started, rt.firstByte),
+		Transfer:  between(rt.firstByte, transferred),
+	}
+}
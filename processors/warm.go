@@ -0,0 +1,168 @@
+package processors
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Warming, if not nil, keeps the responses to a configured set of requests warm in the cache by sending them in the
+// background (see Warmer). It is nil (disabled) by default.
+var Warming *Warmer
+
+// WarmConfig is the configuration of cache warming e.g.
+//
+//	{"warm": [{"url": "https://api.example.com/reports/daily", "headers": {"Accept": "application/json"}, "interval": "15m"}]}
+type WarmConfig struct {
+	Warm []WarmTarget `json:"warm"`
+}
+
+// WarmTarget is a request sent to keep its response warm in the cache, every Interval
+type WarmTarget struct {
+	URL      string
+	Headers  map[string]string
+	Interval time.Duration
+}
+
+// UnmarshalJSON parses a WarmTarget with its interval as a duration e.g. `"15m"` or `"1h30m"`
+func (t *WarmTarget) UnmarshalJSON(data []byte) error {
+	var target struct {
+		URL      string            `json:"url"`
+		Headers  map[string]string `json:"headers"`
+		Interval string            `json:"interval"`
+	}
+	if err := json.Unmarshal(data, &target); err != nil {
+		return err
+	}
+	u, err := url.Parse(target.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q, expected an absolute http or https URL", target.URL)
+	}
+	interval, err := time.ParseDuration(target.Interval)
+	if err != nil || interval < time.Second {
+		return fmt.Errorf("invalid interval %q for %s, expected a duration of at least 1s e.g. 15m", target.Interval, target.URL)
+	}
+	*t = WarmTarget{URL: target.URL, Headers: target.Headers, Interval: interval}
+	return nil
+}
+
+// ParseWarmConfig parses the configuration of cache warming (see WarmConfig)
+func ParseWarmConfig(data []byte) (WarmConfig, error) {
+	var config WarmConfig
+	err := json.Unmarshal(data, &config)
+	return config, err
+}
+
+// WarmStatus is the status of warming the response to a WarmTarget
+type WarmStatus struct {
+	URL      string `json:"url"`
+	Interval string `json:"interval"`
+	// Warmed and Failed count the times the request was sent successfully or not (it failed or its response was an error)
+	Warmed     int        `json:"warmed"`
+	Failed     int        `json:"failed"`
+	LastWarmed *time.Time `json:"lastWarmed,omitempty"`
+	NextWarm   *time.Time `json:"nextWarm,omitempty"`
+	// Status and Cache are the status of the last response and whether it was served from the cache (see CacheHeader)
+	Status string `json:"status,omitempty"`
+	Cache  string `json:"cache,omitempty"`
+}
+
+// Warmer sends a set of requests (see WarmTarget) in the background as soon as it is started and then every interval,
+// so that their responses are kept warm in the cache for the batches which include them. The requests are sent the
+// same way as any batched request (see ProcessBatch) i.e. using the same client, except that they are never served
+// from the cache. Instead the responses stored are revalidated (if they have a validator) or fetched again, and stored
+// in the cache, so they are refreshed before they expire.
+type Warmer struct {
+	targets []WarmTarget
+
+	mu     sync.Mutex
+	status []WarmStatus
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewWarmer creates a Warmer for the specified targets (which is not started)
+func NewWarmer(targets []WarmTarget) *Warmer {
+	w := &Warmer{
+		targets: targets,
+		status:  make([]WarmStatus, len(targets)),
+		stop:    make(chan struct{}),
+	}
+	for i, t := range targets {
+		w.status[i] = WarmStatus{URL: t.URL, Interval: t.Interval.String()}
+	}
+	return w
+}
+
+// Start starts sending the requests in the background
+func (w *Warmer) Start() {
+	for i := range w.targets {
+		w.wg.Add(1)
+		go func(i int) {
+			defer w.wg.Done()
+			ticker := time.NewTicker(w.targets[i].Interval)
+			defer ticker.Stop()
+			for {
+				w.warm(i)
+				select {
+				case <-ticker.C:
+				case <-w.stop:
+					return
+				}
+			}
+		}(i)
+	}
+}
+
+// Stop stops sending the requests, waiting for any being sent
+func (w *Warmer) Stop() {
+	close(w.stop)
+	w.wg.Wait()
+}
+
+// Status returns the status of warming the response to each target
+func (w *Warmer) Status() []WarmStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]WarmStatus(nil), w.status...)
+}
+
+// warm sends the request for a target recording its status
+func (w *Warmer) warm(i int) {
+	target := w.targets[i]
+	request, err := http.NewRequest(http.MethodGet, target.URL, nil)
+	var response *BatchedResponse
+	if err == nil {
+		for name, value := range target.Headers {
+			request.Header.Set(name, value)
+		}
+		var responses []*BatchedResponse
+		if responses, err = ProcessBatch([]*http.Request{request}, DefaultTimeout, BatchOptions{refresh: true}); err == nil {
+			if response = responses[0]; response == nil || response.Header == nil {
+				response, err = nil, fmt.Errorf("no response to %s", target.URL)
+			}
+		}
+	}
+	warmed, next := time.Now(), time.Now().Add(target.Interval)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	status := &w.status[i]
+	status.LastWarmed, status.NextWarm = &warmed, &next
+	status.Status, status.Cache = "", ""
+	switch {
+	case response == nil:
+		status.Failed++
+		status.Status = err.Error()
+	case response.StatusCode >= 400 || response.Header.Get(ErrorCodeHeader) != "":
+		status.Failed++
+		status.Status, status.Cache = response.Status, response.Header.Get(CacheHeader)
+	default:
+		status.Warmed++
+		status.Status, status.Cache = response.Status, response.Header.Get(CacheHeader)
+	}
+}
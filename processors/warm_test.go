@@ -0,0 +1,133 @@
+package processors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWarming(t *testing.T) {
+	var revalidated int64
+	// (the test server signals each request received to revalidate a response and each request which fails,
+	// without blocking if the signals are not waited for)
+	revalidations, failures := make(chan struct{}, 1), make(chan struct{}, 1)
+	signal := func(c chan struct{}) {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/error" {
+			signal(failures)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt64(&revalidated, 1)
+			signal(revalidations)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(r.URL.Path + " " + r.Header.Get("Accept")))
+	}))
+	defer upstream.Close()
+
+	t.Log("We should be able to configure the requests sent to warm the cache")
+	{
+		config, err := ParseWarmConfig([]byte(`{"warm": [{"url": "https://api.example.com/daily", "headers": {"Accept": "application/json"}, "interval": "15m"}]}`))
+		if err == nil && len(config.Warm) == 1 && config.Warm[0].Interval == 15*time.Minute && config.Warm[0].Headers["Accept"] == "application/json" {
+			t.Log("\t\tShould parse the configuration", tick)
+		} else {
+			t.Errorf("\t\tShould parse the configuration, but received %+v %v %v", config, err, cross)
+		}
+		for _, invalid := range []string{
+			`{"warm": [{"url": "/daily", "interval": "15m"}]}`,
+			`{"warm": [{"url": "https://api.example.com/daily", "interval": "15"}]}`,
+			`{"warm": [{"url": "https://api.example.com/daily", "interval": "10ms"}]}`,
+		} {
+			if _, err := ParseWarmConfig([]byte(invalid)); err != nil {
+				t.Logf("\t\tShould return an error for %s %v", invalid, tick)
+			} else {
+				t.Errorf("\t\tShould return an error for %s %v", invalid, cross)
+			}
+		}
+	}
+
+	t.Log("We should be able to warm the cache in the background")
+	{
+		Caching = NewCache(1 << 20)
+		defer func() { Caching = nil }()
+		warmer := NewWarmer([]WarmTarget{
+			{URL: upstream.URL + "/daily", Headers: map[string]string{"Accept": "application/json"}, Interval: 10 * time.Millisecond},
+			{URL: upstream.URL + "/error", Interval: time.Hour},
+		})
+		warmer.Start()
+		// (the response is stored when first warmed and then revalidated each time it is warmed again)
+		waitForSignal(t, failures, "send the request which fails")
+		waitForSignal(t, revalidations, "revalidate the response")
+		waitForSignal(t, revalidations, "revalidate the response again")
+		waitFor(t, func() bool {
+			status := warmer.Status()
+			return status[0].Warmed >= 3 && status[1].Failed >= 1
+		}, "warm the cache in the background")
+		warmer.Stop()
+
+		request, _ := http.NewRequest("GET", upstream.URL+"/daily", nil)
+		request.Header.Set("Accept", "application/json")
+		responses, _ := ProcessBatch([]*http.Request{request}, DefaultTimeout, BatchOptions{})
+		if responses[0].Header.Get(CacheHeader) == "HIT" && body(responses[0]) == "/daily application/json" {
+			t.Log("\t\tShould store the response in the cache and serve it from there", tick)
+		} else {
+			t.Errorf("\t\tShould store the response in the cache and serve it from there, but received %v %v", responses[0].Header, cross)
+		}
+		status := warmer.Status()
+		if status[0].Cache == "REVALIDATED" && status[0].LastWarmed != nil && status[0].NextWarm.After(*status[0].LastWarmed) {
+			t.Log("\t\tShould report the status of warming the response", tick)
+		} else {
+			t.Errorf("\t\tShould report the status of warming the response, but received %+v %v", status[0], cross)
+		}
+		if status[1].Failed == 1 && status[1].Warmed == 0 && status[1].Status == "500 Internal Server Error" {
+			t.Log("\t\tShould report failing to warm the response", tick)
+		} else {
+			t.Errorf("\t\tShould report failing to warm the response, but received %+v %v", status[1], cross)
+		}
+	}
+
+	t.Log("We should refresh the responses warmed in the cache before they expire")
+	{
+		Caching = NewCache(1 << 20)
+		defer func() { Caching = nil }()
+		request, _ := http.NewRequest("GET", upstream.URL+"/daily", nil)
+		ProcessBatch([]*http.Request{request}, DefaultTimeout, BatchOptions{})
+		stored := Caching.lookup(request)
+		before := atomic.LoadInt64(&revalidated)
+		// (clear any signal left over from warming the cache above)
+		select {
+		case <-revalidations:
+		default:
+		}
+
+		// (the response stored is still fresh so would otherwise be served from the cache)
+		warmer := NewWarmer([]WarmTarget{{URL: upstream.URL + "/daily", Interval: time.Hour}})
+		warmer.Start()
+		waitForSignal(t, revalidations, "revalidate the response")
+		waitFor(t, func() bool { return warmer.Status()[0].Warmed >= 1 }, "warm the cache in the background")
+		warmer.Stop()
+		refreshed := Caching.lookup(request)
+		if atomic.LoadInt64(&revalidated) == before+1 && refreshed != nil && refreshed.responseTime.After(stored.responseTime) {
+			t.Log("\t\tShould revalidate the fresh response stored and store it again", tick)
+		} else {
+			t.Errorf("\t\tShould revalidate the fresh response stored and store it again, but received %d revalidations %v", atomic.LoadInt64(&revalidated)-before, cross)
+		}
+		if status := warmer.Status()[0]; status.Cache == "REVALIDATED" {
+			t.Log("\t\tShould report the response as revalidated", tick)
+		} else {
+			t.Errorf("\t\tShould report the response as revalidated, but received %+v %v", status, cross)
+		}
+	}
+}
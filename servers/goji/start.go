@@ -11,6 +11,7 @@ import (
 	"github.com/zenazn/goji/web"
 	"github.com/zenazn/goji/web/middleware"
 
+	"github.com/8legd/RRP/handlers/admin"
 	"github.com/8legd/RRP/handlers/batch"
 	"github.com/8legd/RRP/logging/elf"
 )
@@ -44,7 +45,11 @@ func Start(bind string) {
 	goji.Use(custom)
 
 	goji.Post("/batch/multipartmixed", batch.MultipartMixed)
-	// TODO support other batch requests e.g. AJAX support?
+	goji.Post("/batch/json", batch.JSON)
+	goji.Post("/batch/ndjson", batch.NDJSON)
+	goji.Post("/batch/har", batch.HAR)
+	goji.Get("/admin/coalescing", admin.Coalescing)
+	goji.Get("/admin/warming", admin.Warming)
 
 	flag.Set("bind", bind)
 